@@ -6,6 +6,8 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -19,32 +21,74 @@ type BaseActivity struct {
 	AvgWatts    float32 `json:"average_watts"`
 	AvgCadence  float32 `json:"average_cadence"`
 	ElapsedTime int     `json:"elapsed_time"`
+	Private     bool    `json:"private"`
+	Visibility  string  `json:"visibility"`
+
+	MovingTime   int     `json:"moving_time"`
+	AvgHeartrate float32 `json:"average_heartrate"`
+	MaxHeartrate float32 `json:"max_heartrate"`
+	MaxSpeed     float32 `json:"max_speed"`
+	Kilojoules   float32 `json:"kilojoules"`
+	// Calories, DeviceName and Description are only returned by
+	// FetchActivity, the activity list leaves them empty, see
+	// keepDetails.
+	Calories    float32 `json:"calories"`
+	SufferScore float32 `json:"suffer_score"`
+	GearId      string  `json:"gear_id"`
+	DeviceName  string  `json:"device_name"`
+	Commute     bool    `json:"commute"`
+	Trainer     bool    `json:"trainer"`
+	WorkoutType int     `json:"workout_type"`
+	Description string  `json:"description"`
+
+	// StartLatlng and EndLatlng are [latitude, longitude], empty for
+	// activities without GPS.
+	StartLatlng []float64   `json:"start_latlng"`
+	EndLatlng   []float64   `json:"end_latlng"`
+	Map         ActivityMap `json:"map"`
+}
+
+type ActivityMap struct {
+	// SummaryPolyline is the simplified route as a Google encoded polyline.
+	SummaryPolyline string `json:"summary_polyline" bson:"summary_polyline"`
 }
 
 type RawActivity struct {
 	BaseActivity
-	Type      string `json:"sport_type"`
+	Athlete struct {
+		Id int `json:"id"`
+	} `json:"athlete"`
+	Type      string `json:"type"`
+	SportType string `json:"sport_type"`
 	StartDate string `json:"start_date"`
 }
 
+// ACTIVITY_DATE_FORMAT is the layout of Activity.StartDate, the iCalendar UTC
+// date-time form.
+const ACTIVITY_DATE_FORMAT = "20060102T150405Z"
+
 type Activity struct {
 	BaseActivity `bson:",inline"`
-	Type         string `json:"type"`
-	StartDate    string `json:"start_date"`
-	EndDate      string `json:"end_date"`
+	AthleteId    int `json:"athlete_id" bson:"athlete_id"`
+	// SportType is the Strava sport_type, e.g. MountainBikeRide, and Type
+	// the legacy, coarser, type, e.g. Ride. Both are the Strava values, the
+	// display name depends on the feed language.
+	SportType string `json:"sport_type" bson:"sport_type"`
+	Type      string `json:"type"`
+	// StartDate is in UTC, the end depends on the feed, see
+	// FeedSettings.EndTime.
+	StartDate string `json:"start_date"`
 }
 
-func FetchActivity(accessToken string, activityId int) (*Activity, error) {
-	url := fmt.Sprintf("https://www.strava.com/api/v3/activities/%d", activityId)
-
-	req, err := http.NewRequest("GET", url, nil)
+func (c *StravaClient) FetchActivity(accessToken string, activityId int) (*Activity, error) {
+	req, err := c.newRequest("GET", fmt.Sprintf("/api/v3/activities/%d", activityId), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -66,17 +110,47 @@ func FetchActivity(accessToken string, activityId int) (*Activity, error) {
 	return activity.toActivity(), nil
 }
 
-func FetchAthleteActivities(accessToken string) ([]Activity, error) {
-	url := "https://www.strava.com/api/v3/athlete/activities?per_page=200"
+const ACTIVITIES_PER_PAGE = 200
 
-	req, err := http.NewRequest("GET", url, nil)
+// FetchAthleteActivities pages through the athlete's activities started
+// strictly between after and before (unix timestamps, 0 leaves the bound
+// open).
+func (c *StravaClient) FetchAthleteActivities(accessToken string, after, before int64) ([]Activity, error) {
+	var result []Activity
+	for page := 1; ; page++ {
+		activities, err := c.fetchAthleteActivitiesPage(accessToken, after, before, page)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("Fetched athlete activities page", "page", page, "count", len(activities))
+		if len(activities) == 0 {
+			return result, nil
+		}
+		for _, raw := range activities {
+			result = append(result, *raw.toActivity())
+		}
+	}
+}
+
+func (c *StravaClient) fetchAthleteActivitiesPage(accessToken string, after, before int64, page int) ([]RawActivity, error) {
+	q := url.Values{}
+	q.Set("per_page", strconv.Itoa(ACTIVITIES_PER_PAGE))
+	q.Set("page", strconv.Itoa(page))
+	if after > 0 {
+		q.Set("after", strconv.FormatInt(after, 10))
+	}
+	if before > 0 {
+		q.Set("before", strconv.FormatInt(before, 10))
+	}
+
+	req, err := c.newRequest("GET", "/api/v3/athlete/activities", q)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Add("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -89,73 +163,166 @@ func FetchAthleteActivities(accessToken string) ([]Activity, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&activities); err != nil {
 		return nil, err
 	}
+	return activities, nil
+}
 
-	var result []Activity
-	for _, raw := range activities {
-		result = append(result, *raw.toActivity())
-	}
-
-	return result, nil
-}
-
-func formatActivityType(activityType string) string {
-	typeMap := map[string]string{
-		"AlpineSki":                     "Alpine Ski",
-		"BackcountrySki":                "Backcountry Ski",
-		"Badminton":                     "Badminton",
-		"Canoeing":                      "Canoeing",
-		"Crossfit":                      "Crossfit",
-		"EBikeRide":                     "E-Bike Ride",
-		"Elliptical":                    "Elliptical",
-		"EMountainBikeRide":             "E-Mountain Bike Ride",
-		"Golf":                          "Golf",
-		"GravelRide":                    "Gravel Ride",
-		"Handcycle":                     "Handcycle",
-		"HighIntensityIntervalTraining": "High Intensity Interval Training",
-		"Hike":                          "Hike",
-		"IceSkate":                      "Ice Skate",
-		"InlineSkate":                   "Inline Skate",
-		"Kayaking":                      "Kayaking",
-		"Kitesurf":                      "Kitesurf",
-		"MountainBikeRide":              "Mountain Bike Ride",
-		"NordicSki":                     "Nordic Ski",
-		"Pickleball":                    "Pickleball",
-		"Pilates":                       "Pilates",
-		"Racquetball":                   "Racquetball",
-		"Ride":                          "Ride",
-		"RockClimbing":                  "Rock Climbing",
-		"RollerSki":                     "Roller Ski",
-		"Rowing":                        "Rowing",
-		"Run":                           "Run",
-		"Sail":                          "Sail",
-		"Skateboard":                    "Skateboard",
-		"Snowboard":                     "Snowboard",
-		"Snowshoe":                      "Snowshoe",
-		"Soccer":                        "Soccer",
-		"Squash":                        "Squash",
-		"StairStepper":                  "Stair Stepper",
-		"StandUpPaddling":               "Stand Up Paddling",
-		"Surfing":                       "Surfing",
-		"Swim":                          "Swim",
-		"TableTennis":                   "Table Tennis",
-		"Tennis":                        "Tennis",
-		"TrailRun":                      "Trail Run",
-		"Velomobile":                    "Velomobile",
-		"VirtualRide":                   "Virtual Ride",
-		"VirtualRow":                    "Virtual Row",
-		"VirtualRun":                    "Virtual Run",
-		"Walk":                          "Walk",
-		"WeightTraining":                "Weight Training",
-		"Wheelchair":                    "Wheelchair",
-		"Windsurf":                      "Windsurf",
-		"Workout":                       "Workout",
-		"Yoga":                          "Yoga",
-	}
-
-	if formatted, ok := typeMap[activityType]; ok {
-		return formatted
-	}
-	return activityType
+// activityTypeNames maps the Strava sport_type values to their English display
+// name, see locale.go for the other languages.
+var activityTypeNames = map[string]string{
+	"AlpineSki":                     "Alpine Ski",
+	"BackcountrySki":                "Backcountry Ski",
+	"Badminton":                     "Badminton",
+	"Canoeing":                      "Canoeing",
+	"Crossfit":                      "Crossfit",
+	"EBikeRide":                     "E-Bike Ride",
+	"Elliptical":                    "Elliptical",
+	"EMountainBikeRide":             "E-Mountain Bike Ride",
+	"Golf":                          "Golf",
+	"GravelRide":                    "Gravel Ride",
+	"Handcycle":                     "Handcycle",
+	"HighIntensityIntervalTraining": "High Intensity Interval Training",
+	"Hike":                          "Hike",
+	"IceSkate":                      "Ice Skate",
+	"InlineSkate":                   "Inline Skate",
+	"Kayaking":                      "Kayaking",
+	"Kitesurf":                      "Kitesurf",
+	"MountainBikeRide":              "Mountain Bike Ride",
+	"NordicSki":                     "Nordic Ski",
+	"Pickleball":                    "Pickleball",
+	"Pilates":                       "Pilates",
+	"Racquetball":                   "Racquetball",
+	"Ride":                          "Ride",
+	"RockClimbing":                  "Rock Climbing",
+	"RollerSki":                     "Roller Ski",
+	"Rowing":                        "Rowing",
+	"Run":                           "Run",
+	"Sail":                          "Sail",
+	"Skateboard":                    "Skateboard",
+	"Snowboard":                     "Snowboard",
+	"Snowshoe":                      "Snowshoe",
+	"Soccer":                        "Soccer",
+	"Squash":                        "Squash",
+	"StairStepper":                  "Stair Stepper",
+	"StandUpPaddling":               "Stand Up Paddling",
+	"Surfing":                       "Surfing",
+	"Swim":                          "Swim",
+	"TableTennis":                   "Table Tennis",
+	"Tennis":                        "Tennis",
+	"TrailRun":                      "Trail Run",
+	"Velomobile":                    "Velomobile",
+	"VirtualRide":                   "Virtual Ride",
+	"VirtualRow":                    "Virtual Row",
+	"VirtualRun":                    "Virtual Run",
+	"Walk":                          "Walk",
+	"WeightTraining":                "Weight Training",
+	"Wheelchair":                    "Wheelchair",
+	"Windsurf":                      "Windsurf",
+	"Workout":                       "Workout",
+	"Yoga":                          "Yoga",
+}
+
+// legacyActivityTypes maps the sport types missing from the legacy types to
+// the legacy type Strava reports for them, the others are the same in both.
+var legacyActivityTypes = map[string]string{
+	"EMountainBikeRide":             "EBikeRide",
+	"GravelRide":                    "Ride",
+	"MountainBikeRide":              "Ride",
+	"TrailRun":                      "Run",
+	"VirtualRow":                    "Rowing",
+	"Badminton":                     "Workout",
+	"HighIntensityIntervalTraining": "Workout",
+	"Pickleball":                    "Workout",
+	"Pilates":                       "Workout",
+	"Racquetball":                   "Workout",
+	"Squash":                        "Workout",
+	"TableTennis":                   "Workout",
+	"Tennis":                        "Workout",
+}
+
+func legacyActivityType(sportType string) string {
+	if legacyType, ok := legacyActivityTypes[sportType]; ok {
+		return legacyType
+	}
+	return sportType
+}
+
+// activityTypeFromName maps an English display name, as stored before the
+// sport types were, back to the Strava sport type. Sport types and unknown
+// names are returned unchanged.
+func activityTypeFromName(name string) string {
+	for sportType, displayName := range activityTypeNames {
+		if displayName == name {
+			return sportType
+		}
+	}
+	return name
+}
+
+// migrateType converts an activity stored with the English display name of
+// its sport type in Type, reporting whether it had to.
+func (a *Activity) migrateType() bool {
+	if a.SportType != "" {
+		return false
+	}
+	a.SportType = activityTypeFromName(a.Type)
+	a.Type = legacyActivityType(a.SportType)
+	return true
+}
+
+// keepDetails fills the detail-only fields left empty, as in the activity
+// list, from the stored copy of the activity.
+func (a *Activity) keepDetails(stored *Activity) {
+	if a.Description == "" {
+		a.Description = stored.Description
+	}
+	if a.Calories == 0 {
+		a.Calories = stored.Calories
+	}
+	if a.DeviceName == "" {
+		a.DeviceName = stored.DeviceName
+	}
+}
+
+// IsPrivate reports whether only the athlete can see the activity on Strava.
+func (a *Activity) IsPrivate() bool {
+	return a.Private || a.Visibility == "only_me"
+}
+
+// applyUpdates applies the "updates" of an activity update webhook event. It
+// returns false, leaving the activity untouched, when the event changes
+// something that can only be known by fetching the activity again.
+// The event must come from the application's subscription, see handleHook.
+func (a *Activity) applyUpdates(updates WebhookUpdates) bool {
+	if len(updates) == 0 {
+		return false
+	}
+	updated := *a
+	for key, value := range updates {
+		switch key {
+		case "title":
+			updated.Name = value
+		case "type":
+			// The legacy type, a GravelRide comes as a Ride: the sport type
+			// is only known by fetching the activity.
+			return false
+		case "private":
+			private, err := strconv.ParseBool(value)
+			if err != nil {
+				return false
+			}
+			if private {
+				updated.Visibility = "only_me"
+			} else if updated.Visibility == "only_me" {
+				// The visibility it went back to is unknown.
+				return false
+			}
+			updated.Private = private
+		default:
+			return false
+		}
+	}
+	*a = updated
+	return true
 }
 
 func (r *RawActivity) toActivity() *Activity {
@@ -163,13 +330,13 @@ func (r *RawActivity) toActivity() *Activity {
 	if err != nil {
 		startDate = time.Time{}
 	}
-	endDate := startDate.Add(time.Duration(r.ElapsedTime) * time.Second)
 
 	activity := &Activity{
-		Type:         formatActivityType(r.Type),
+		SportType:    r.SportType,
+		Type:         r.Type,
 		BaseActivity: r.BaseActivity,
-		StartDate:    startDate.UTC().Format("20060102T150405Z"),
-		EndDate:      endDate.UTC().Format("20060102T150405Z"),
+		AthleteId:    r.Athlete.Id,
+		StartDate:    startDate.UTC().Format(ACTIVITY_DATE_FORMAT),
 	}
 
 	return activity
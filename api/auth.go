@@ -1,35 +1,49 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// errUnauthorized is returned when Strava rejects the athlete's tokens, the
+// athlete revoked the application's access.
+var errUnauthorized = errors.New("strava rejected the athlete's token")
+
 type StravaToken struct {
+	AthleteId    int    `json:"-" bson:"_id"`
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	ExpiresAt    int64  `json:"expires_at"`
+	FeedToken    string `json:"-" bson:"feed_token,omitempty"`
+	// ManagementToken is the SHA-256 of the token authenticating the athlete
+	// on the API, see authenticateAthlete.
+	ManagementToken string `json:"-" bson:"management_token,omitempty"`
+	// LastFetchAt is when /fetch last walked the athlete's history up to the
+	// present, zero until it did once.
+	LastFetchAt time.Time `json:"-" bson:"last_fetch_at,omitempty"`
+	// FeedSettings is nil until the athlete customizes their feed.
+	FeedSettings *FeedSettings `json:"-" bson:"feed_settings,omitempty"`
 }
 
-func ExchangeCode(code string) (*StravaToken, error) {
-	url := "https://www.strava.com/oauth/token"
+func (c *StravaClient) ExchangeCode(code string) (*StravaToken, error) {
+	q := c.clientQuery()
+	q.Add("code", code)
+	q.Add("grant_type", "authorization_code")
 
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := c.newRequest("POST", "/oauth/token", q)
 	if err != nil {
 		return nil, err
 	}
 
-	q := req.URL.Query()
-	q.Add("client_id", CLIENT_ID)
-	q.Add("client_secret", CLIENT_SECRET)
-	q.Add("code", code)
-	q.Add("grant_type", "authorization_code")
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -38,34 +52,43 @@ func ExchangeCode(code string) (*StravaToken, error) {
 		return nil, fmt.Errorf("failed to exchange code, status code: %d", resp.StatusCode)
 	}
 
-	var token StravaToken
-	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+	var content struct {
+		StravaToken
+		Athlete struct {
+			Id int `json:"id"`
+		} `json:"athlete"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&content); err != nil {
 		return nil, err
 	}
+	if content.Athlete.Id == 0 {
+		return nil, fmt.Errorf("token exchange response is missing the athlete id")
+	}
 
+	token := content.StravaToken
+	token.AthleteId = content.Athlete.Id
 	return &token, nil
 }
 
-func RefreshToken(refreshToken string) (*StravaToken, error) {
-	url := "https://www.strava.com/oauth/token"
+func (c *StravaClient) RefreshToken(refreshToken string) (*StravaToken, error) {
+	q := c.clientQuery()
+	q.Add("grant_type", "refresh_token")
+	q.Add("refresh_token", refreshToken)
 
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := c.newRequest("POST", "/oauth/token", q)
 	if err != nil {
 		return nil, err
 	}
 
-	q := req.URL.Query()
-	q.Add("client_id", CLIENT_ID)
-	q.Add("client_secret", CLIENT_SECRET)
-	q.Add("grant_type", "refresh_token")
-	q.Add("refresh_token", refreshToken)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		// Strava answers 400 to a refresh token that was revoked.
+		return nil, fmt.Errorf("failed to refresh token, status code: %d: %w", resp.StatusCode, errUnauthorized)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to refresh token, status code: %d", resp.StatusCode)
 	}
@@ -78,26 +101,166 @@ func RefreshToken(refreshToken string) (*StravaToken, error) {
 	return &token, nil
 }
 
+// FetchAthlete returns the id of the athlete the access token belongs to.
+func (c *StravaClient) FetchAthlete(accessToken string) (int, error) {
+	req, err := c.newRequest("GET", "/api/v3/athlete", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return 0, fmt.Errorf("failed to fetch athlete: %w", errUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to fetch athlete, status code: %d", resp.StatusCode)
+	}
+
+	var athlete struct {
+		Id int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&athlete); err != nil {
+		return 0, err
+	}
+	return athlete.Id, nil
+}
+
 func (token *StravaToken) IsTokenExpired() bool {
 	return time.Now().Unix() >= token.ExpiresAt-10
 }
 
-func RefreshTokenIfExpired() (*StravaToken, error) {
-	token, err := getToken()
+func RefreshTokenIfExpired(athleteId int) (*StravaToken, error) {
+	token, err := store.GetToken(athleteId)
 	if err != nil || token == nil {
 		return token, err
 	}
 	if !token.IsTokenExpired() {
 		return token, nil
 	}
-	slog.Info("Access token expired, refreshing token")
-	newToken, err := RefreshToken(token.RefreshToken)
+	slog.Info("Access token expired, refreshing token", "athlete_id", athleteId)
+	newToken, err := strava.RefreshToken(token.RefreshToken)
 	if err != nil {
 		return nil, err
 	}
-	if err := saveToken(newToken); err != nil {
+	newToken.AthleteId = athleteId
+	if err := store.SaveToken(newToken); err != nil {
 		return nil, err
 	}
-	slog.Info("Access token refreshed successfully")
+	slog.Info("Access token refreshed successfully", "athlete_id", athleteId)
 	return newToken, nil
 }
+
+// newManagementToken mints a management token for the athlete, replacing the
+// previous one, and returns it. Only its hash is stored so it can't be
+// shown again.
+func newManagementToken(athleteId int) (string, error) {
+	managementToken := rand.Text()
+	if err := store.SetManagementToken(athleteId, hashManagementToken(managementToken)); err != nil {
+		return "", err
+	}
+	return managementToken, nil
+}
+
+func hashManagementToken(managementToken string) string {
+	sum := sha256.Sum256([]byte(managementToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateAthlete identifies the athlete from their management token,
+// given as a bearer token. It is never accepted in the URL so that it doesn't
+// end up in logs and histories like the calendar feed token, which only grants
+// read access to the calendar. It replies 401 when the token is unknown.
+func authenticateAthlete(w http.ResponseWriter, r *http.Request) (*StravaToken, bool) {
+	managementToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || managementToken == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	token, err := store.GetTokenByManagement(hashManagementToken(managementToken))
+	if err != nil {
+		http.Error(w, "Failed to load token", http.StatusInternalServerError)
+		return nil, false
+	}
+	if token == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return token, true
+}
+
+// legacyTokenAthlete resolves the athlete of the token stored before tokens
+// were keyed by athlete, refreshing it first if it expired.
+func legacyTokenAthlete(token *StravaToken) (int, error) {
+	if token.IsTokenExpired() {
+		refreshed, err := strava.RefreshToken(token.RefreshToken)
+		if err != nil {
+			return 0, err
+		}
+		token.AccessToken = refreshed.AccessToken
+		token.RefreshToken = refreshed.RefreshToken
+		token.ExpiresAt = refreshed.ExpiresAt
+	}
+	return strava.FetchAthlete(token.AccessToken)
+}
+
+// AuditEntry records an action taken on an athlete's data.
+type AuditEntry struct {
+	Time      time.Time `json:"time" bson:"time"`
+	AthleteId int       `json:"athlete_id" bson:"athlete_id"`
+	Action    string    `json:"action" bson:"action"`
+	Details   string    `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+// accessRevoked asks Strava whether the athlete revoked the application's
+// access: their tokens are then rejected.
+func accessRevoked(athleteId int) (bool, error) {
+	token, err := RefreshTokenIfExpired(athleteId)
+	if errors.Is(err, errUnauthorized) {
+		return true, nil
+	}
+	if err != nil || token == nil {
+		return false, err
+	}
+	_, err = strava.FetchAthlete(token.AccessToken)
+	if errors.Is(err, errUnauthorized) {
+		return true, nil
+	}
+	return false, err
+}
+
+// deauthorizeAthlete forgets everything stored about an athlete who revoked
+// the application's access on Strava, as the Strava API agreement requires.
+// The data is only deleted once Strava confirms the revocation.
+func deauthorizeAthlete(athleteId int) error {
+	revoked, err := accessRevoked(athleteId)
+	if err != nil {
+		return fmt.Errorf("failed to confirm the revocation: %w", err)
+	}
+	if !revoked {
+		slog.Warn("Deauthorization event not confirmed by Strava, keeping the athlete data", "athlete_id", athleteId)
+		return nil
+	}
+
+	slog.Info("Athlete revoked access, deleting their data", "athlete_id", athleteId)
+	if err := store.DeleteAthlete(athleteId); err != nil {
+		return fmt.Errorf("failed to delete athlete data: %w", err)
+	}
+
+	entry := &AuditEntry{
+		Time:      time.Now().UTC(),
+		AthleteId: athleteId,
+		Action:    "deauthorized",
+		Details:   "token, feed token and activities deleted",
+	}
+	if err := store.SaveAuditEntry(entry); err != nil {
+		return fmt.Errorf("failed to save audit entry: %w", err)
+	}
+	slog.Info("Audit", "athlete_id", entry.AthleteId, "action", entry.Action, "details", entry.Details)
+	return nil
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"strava2cal/ical"
+)
+
+const ICAL_PRODID = "-//Strava To Calendar//EN"
+
+func newFeedToken() string {
+	return rand.Text()
+}
+
+// ensureFeedToken returns the athlete's calendar feed token, minting one if
+// the athlete doesn't have any yet (first authorization or after a revoke).
+func ensureFeedToken(athleteId int) (string, error) {
+	token, err := store.GetToken(athleteId)
+	if err != nil {
+		return "", err
+	}
+	if token != nil && token.FeedToken != "" {
+		return token.FeedToken, nil
+	}
+	feedToken := newFeedToken()
+	if err := store.SetFeedToken(athleteId, feedToken); err != nil {
+		return "", err
+	}
+	return feedToken, nil
+}
+
+const (
+	PRIVACY_EXCLUDE = "exclude"
+	PRIVACY_REDACT  = "redact"
+	PRIVACY_INCLUDE = "include"
+)
+
+// FeedSettings controls how a calendar feed renders the activities.
+type FeedSettings struct {
+	// Privacy is what happens to private activities: PRIVACY_EXCLUDE (the
+	// default) leaves them out, PRIVACY_REDACT keeps the event but hides its
+	// name and description, PRIVACY_INCLUDE shows them like any other.
+	Privacy string `json:"privacy" bson:"privacy"`
+	// TitleTemplate and DescriptionTemplate are text/template strings
+	// rendering the event from the Activity, see templates.go. Empty means the
+	// default template.
+	TitleTemplate       string `json:"title_template,omitempty" bson:"title_template,omitempty"`
+	DescriptionTemplate string `json:"description_template,omitempty" bson:"description_template,omitempty"`
+	// Units is UNITS_METRIC (the default) or UNITS_IMPERIAL, the ?units=
+	// query parameter overrides it.
+	Units string `json:"units,omitempty" bson:"units,omitempty"`
+	// Language is one of the locales, empty follows the calendar client
+	// Accept-Language header.
+	Language string `json:"language,omitempty" bson:"language,omitempty"`
+	// EndTime is how the event end is derived from the activity start:
+	// END_TIME_ELAPSED (the default), END_TIME_MOVING or END_TIME_FIXED, which
+	// lasts FixedDuration, e.g. "1h".
+	EndTime       string `json:"end_time,omitempty" bson:"end_time,omitempty"`
+	FixedDuration string `json:"fixed_duration,omitempty" bson:"fixed_duration,omitempty"`
+	// Home, optional, hides the position of the activities around it.
+	Home *HomeSettings `json:"home,omitempty" bson:"home,omitempty"`
+}
+
+const (
+	END_TIME_ELAPSED = "elapsed"
+	END_TIME_MOVING  = "moving"
+	END_TIME_FIXED   = "fixed"
+)
+
+func (s FeedSettings) Validate() error {
+	switch s.Privacy {
+	case "", PRIVACY_EXCLUDE, PRIVACY_REDACT, PRIVACY_INCLUDE:
+	default:
+		return fmt.Errorf("invalid privacy policy %q, expected %s, %s or %s", s.Privacy, PRIVACY_EXCLUDE, PRIVACY_REDACT, PRIVACY_INCLUDE)
+	}
+	if _, ok := unitSystems[s.units()]; !ok {
+		return fmt.Errorf("invalid units %q, expected %s or %s", s.Units, UNITS_METRIC, UNITS_IMPERIAL)
+	}
+	switch s.EndTime {
+	case "", END_TIME_ELAPSED, END_TIME_MOVING:
+	case END_TIME_FIXED:
+		if duration, err := time.ParseDuration(s.FixedDuration); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid fixed duration %q, expected a positive duration such as 45m or 1h", s.FixedDuration)
+		}
+	default:
+		return fmt.Errorf("invalid end time %q, expected %s, %s or %s", s.EndTime, END_TIME_ELAPSED, END_TIME_MOVING, END_TIME_FIXED)
+	}
+	if s.Home != nil {
+		if err := s.Home.Validate(); err != nil {
+			return err
+		}
+	}
+	if _, ok := locales[s.Language]; s.Language != "" && !ok {
+		return fmt.Errorf("invalid language %q, expected one of %s", s.Language, strings.Join(supportedLanguages(), ", "))
+	}
+	if _, err := s.eventTemplates((&Feed{Settings: s}).mapUrl); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s FeedSettings) privacy() string {
+	if s.Privacy == "" {
+		return PRIVACY_EXCLUDE
+	}
+	return s.Privacy
+}
+
+// feedActivity is an activity as a feed may show it, see
+// FeedSettings.feedActivity.
+type feedActivity struct {
+	Activity
+	// Redacted tells the activity is private and was redacted.
+	Redacted bool
+	// Rounded tells the coordinates were rounded around the home.
+	Rounded bool
+}
+
+// feedActivity applies the privacy policies to a copy of the activity, the
+// same for the calendars, the tracks and the maps, returning nil when it
+// must be left out. Private activities are left out or, with PRIVACY_REDACT,
+// named after their sport and stripped of their description, coordinates and
+// route. Activities starting or ending around the home lose their route,
+// which would lead to it, and get their coordinates rounded or removed as
+// the home privacy says.
+func (s FeedSettings) feedActivity(activity *Activity) *feedActivity {
+	shown := &feedActivity{Activity: *activity}
+	if activity.IsPrivate() {
+		switch s.privacy() {
+		case PRIVACY_EXCLUDE:
+			return nil
+		case PRIVACY_REDACT:
+			shown.Name = getLocale(s.Language).typeName(activity.SportType)
+			shown.Description = ""
+			shown.StartLatlng, shown.EndLatlng = nil, nil
+			shown.Map = ActivityMap{}
+			shown.Redacted = true
+			return shown
+		}
+	}
+	if s.Home != nil && (s.Home.isNear(activity.StartLatlng) || s.Home.isNear(activity.EndLatlng)) {
+		shown.Map = ActivityMap{}
+		if s.Home.privacy() == HOME_PRIVACY_ROUND {
+			shown.StartLatlng, shown.EndLatlng = roundLatlng(activity.StartLatlng), roundLatlng(activity.EndLatlng)
+			shown.Rounded = true
+		} else {
+			shown.StartLatlng, shown.EndLatlng = nil, nil
+		}
+	}
+	return shown
+}
+
+// eventDuration is how long the activity event lasts under the end time
+// policy. Activities stored before the moving time was fall back to the
+// elapsed time.
+func (s FeedSettings) eventDuration(activity *Activity) time.Duration {
+	switch s.EndTime {
+	case END_TIME_MOVING:
+		if activity.MovingTime > 0 {
+			return time.Duration(activity.MovingTime) * time.Second
+		}
+	case END_TIME_FIXED:
+		if duration, err := time.ParseDuration(s.FixedDuration); err == nil {
+			return duration
+		}
+	}
+	return time.Duration(activity.ElapsedTime) * time.Second
+}
+
+func (s FeedSettings) units() string {
+	if s.Units == "" {
+		return UNITS_METRIC
+	}
+	return s.Units
+}
+
+func (s FeedSettings) formatter() formatter {
+	return formatter{units: unitSystems[s.units()], locale: getLocale(s.Language)}
+}
+
+// applyQuerySettings applies the settings the calendar request may override.
+func (s *FeedSettings) applyQuerySettings(r *http.Request) error {
+	if s.Language == "" {
+		s.Language = acceptLanguage(r.Header.Get("Accept-Language"))
+	}
+	if units := r.URL.Query().Get("units"); units != "" {
+		if _, ok := unitSystems[units]; !ok {
+			return fmt.Errorf("invalid units parameter, expected %s or %s", UNITS_METRIC, UNITS_IMPERIAL)
+		}
+		s.Units = units
+	}
+	return nil
+}
+
+func (t *StravaToken) feedSettings() FeedSettings {
+	if t.FeedSettings == nil {
+		return FeedSettings{}
+	}
+	return *t.FeedSettings
+}
+
+// loadFeedOwner returns the token owning the feed token, replying 404 when
+// there is none.
+func loadFeedOwner(w http.ResponseWriter, r *http.Request, feedToken string) (*StravaToken, bool) {
+	token, err := store.GetTokenByFeed(feedToken)
+	if err != nil {
+		http.Error(w, "Failed to load token", http.StatusInternalServerError)
+		return nil, false
+	}
+	if token == nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return token, true
+}
+
+// loadOwnFeedToken authenticates the athlete by their management token and
+// returns their token if the feed token of the path is theirs, replying 404
+// otherwise.
+func loadOwnFeedToken(w http.ResponseWriter, r *http.Request) (*StravaToken, bool) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return nil, false
+	}
+	if token.FeedToken == "" || token.FeedToken != r.PathValue("token") {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return token, true
+}
+
+// handlePreflight lets the web page send the management token to the API
+// from another origin.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// calendarName is the feed display name, spelling out the filter so that
+// several feeds of the same account can be told apart.
+func calendarName(filter ActivityFilter, loc *locale) string {
+	if filter.IsEmpty() {
+		return "Strava"
+	}
+	return "Strava - " + filter.Describe(loc)
+}
+
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	feedToken, ok := strings.CutSuffix(r.PathValue("file"), ".ics")
+	if !ok || feedToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	token, ok := loadFeedOwner(w, r, feedToken)
+	if !ok {
+		return
+	}
+	filter, err := parseActivityFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings := token.feedSettings()
+	if err := settings.applyQuerySettings(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeCalendar(w, &Feed{
+		AthleteId: token.AthleteId,
+		Name:      calendarName(filter, getLocale(settings.Language)),
+		Filter:    filter,
+		Settings:  settings,
+	})
+}
+
+// writeCalendar renders the feed's activities as an iCalendar response.
+func writeCalendar(w http.ResponseWriter, feed *Feed) {
+	settings := feed.Settings
+	templates, err := settings.eventTemplates(feed.mapUrl)
+	if err != nil {
+		http.Error(w, "Invalid feed templates", http.StatusInternalServerError)
+		return
+	}
+	activities, err := store.GetActivities(feed.AthleteId, feed.Filter)
+	if err != nil {
+		http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+		return
+	}
+
+	calendar := &ical.Calendar{ProdId: ICAL_PRODID, Name: feed.Name}
+	if feed.Color != "" {
+		calendar.Properties = append(calendar.Properties, ical.Property{Name: "X-APPLE-CALENDAR-COLOR", Value: feed.Color})
+	}
+	timezones := make(map[string]*ical.Timezone)
+	now := time.Now().UTC()
+
+	for i := range activities {
+		activity := settings.feedActivity(&activities[i])
+		if activity == nil {
+			continue
+		}
+
+		event := ical.Event{
+			UID:   fmt.Sprintf("%d@strava2cal", activity.Id),
+			Stamp: now,
+		}
+		if activity.Redacted {
+			event.Summary = activity.Name
+			event.Class = "PRIVATE"
+		} else {
+			event.Summary = templates.title(&activity.Activity)
+			event.Description = templates.description(&activity.Activity)
+			event.Properties = append(event.Properties, ical.Property{Name: "URL", Value: fmt.Sprintf("https://www.strava.com/activities/%d", activity.Id)})
+		}
+		if place := activity.eventPlace(); place != nil {
+			geo := ical.Geo{Lat: place.Lat, Lng: place.Lng}
+			event.Geo = &geo
+			event.Location = place.Name
+			if place.Name != "" {
+				radius := 0.0
+				if place.Rounded {
+					radius = ROUNDED_RADIUS
+				}
+				event.Properties = append(event.Properties, ical.StructuredLocationProperty(place.Name, geo, radius))
+			}
+		}
+		if mapUrl := feed.mapUrl(&activity.Activity); mapUrl != "" {
+			event.Properties = append(event.Properties, ical.Property{
+				Name:   "ATTACH",
+				Params: []ical.Param{{Name: "FMTTYPE", Value: "image/png"}},
+				Value:  mapUrl,
+			})
+		}
+
+		event.Start, _ = time.Parse(ACTIVITY_DATE_FORMAT, activity.StartDate)
+		event.End = event.Start.Add(settings.eventDuration(&activity.Activity))
+		if loc := activityLocation(activity.Timezone); loc != nil {
+			tz, ok := timezones[loc.String()]
+			if !ok {
+				tz = ical.NewTimezone(loc)
+				timezones[loc.String()] = tz
+				calendar.Timezones = append(calendar.Timezones, tz)
+			}
+			tz.Add(event.Start, event.End)
+			event.TZ = loc
+		}
+
+		calendar.Events = append(calendar.Events, event)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"strava.ics\"")
+	w.WriteHeader(http.StatusOK)
+	if err := calendar.Encode(w); err != nil {
+		slog.Error("Failed to write calendar", "error", err, "athlete_id", feed.AthleteId)
+	}
+}
+
+// handleRotateFeedToken replaces the feed token with a fresh one. The old
+// calendar URL stops working immediately.
+func handleRotateFeedToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	token, ok := loadOwnFeedToken(w, r)
+	if !ok {
+		return
+	}
+
+	feedToken := newFeedToken()
+	if err := store.SetFeedToken(token.AthleteId, feedToken); err != nil {
+		http.Error(w, "Failed to save feed token", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Calendar feed token rotated", "athlete_id", token.AthleteId)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"feed_token":"%s","calendar_url":"%s/calendar/%s.ics"}`, feedToken, APP_ADDRESS, feedToken)
+}
+
+// handleRevokeFeedToken disables the calendar feed. A new token is minted the
+// next time the athlete goes through the Strava authorization.
+func handleRevokeFeedToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	token, ok := loadOwnFeedToken(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.SetFeedToken(token.AthleteId, ""); err != nil {
+		http.Error(w, "Failed to revoke feed token", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Calendar feed token revoked", "athlete_id", token.AthleteId)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"feed token revoked"}`))
+}
+
+// handleGetFeedSettings and handleSaveFeedSettings need the management token,
+// the feed token alone only grants read access to the calendar.
+func handleGetFeedSettings(w http.ResponseWriter, r *http.Request) {
+	token, ok := loadOwnFeedToken(w, r)
+	if !ok {
+		return
+	}
+	settings := token.feedSettings()
+	settings.Privacy = settings.privacy()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(settings)
+}
+
+func handleSaveFeedSettings(w http.ResponseWriter, r *http.Request) {
+	token, ok := loadOwnFeedToken(w, r)
+	if !ok {
+		return
+	}
+
+	var settings FeedSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Failed to parse feed settings", http.StatusBadRequest)
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.SetFeedSettings(token.AthleteId, settings); err != nil {
+		http.Error(w, "Failed to save feed settings", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Calendar feed settings saved", "athlete_id", token.AthleteId)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"feed settings saved"}`))
+}
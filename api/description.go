@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	UNITS_METRIC   = "metric"
+	UNITS_IMPERIAL = "imperial"
+)
+
+// unitSystem holds how distances, elevations and speeds are printed, each
+// unit given with its length in meters.
+type unitSystem struct {
+	distanceUnit    string
+	distanceMeters  float64
+	elevationUnit   string
+	elevationMeters float64
+	speedUnit       string
+	// swimUnit is the distance swim paces are given for.
+	swimUnit   string
+	swimMeters float64
+}
+
+var unitSystems = map[string]unitSystem{
+	UNITS_METRIC: {
+		distanceUnit: "km", distanceMeters: 1000,
+		elevationUnit: "m", elevationMeters: 1,
+		speedUnit: "km/h",
+		swimUnit:  "100m", swimMeters: 100,
+	},
+	UNITS_IMPERIAL: {
+		distanceUnit: "mi", distanceMeters: 1609.344,
+		elevationUnit: "ft", elevationMeters: 0.3048,
+		speedUnit: "mph",
+		swimUnit:  "100yd", swimMeters: 91.44,
+	},
+}
+
+// Sports whose average speed reads better as a pace, per distance unit or
+// per swimUnit.
+var (
+	paceSports = []string{"Run", "TrailRun", "VirtualRun", "Walk", "Hike"}
+	swimSports = []string{"Swim"}
+)
+
+func isSport(activity *Activity, sports []string) bool {
+	return slices.Contains(sports, activity.SportType)
+}
+
+// formatter prints the activity figures in a unit system and language.
+type formatter struct {
+	units  unitSystem
+	locale *locale
+}
+
+func (f formatter) distance(meters float32) string {
+	return f.locale.number(float64(meters)/f.units.distanceMeters, 2) + f.units.distanceUnit
+}
+
+func (f formatter) elevation(meters float32) string {
+	return f.locale.number(float64(meters)/f.units.elevationMeters, 0) + f.units.elevationUnit
+}
+
+// speed formats the average speed the way the sport measures it: a pace for
+// runs, walks and swims, a speed otherwise.
+func (f formatter) speed(activity *Activity) string {
+	switch {
+	case isSport(activity, swimSports):
+		return formatPace(activity.AvgSpeed, f.units.swimMeters) + "/" + f.units.swimUnit
+	case isSport(activity, paceSports):
+		return formatPace(activity.AvgSpeed, f.units.distanceMeters) + "/" + f.units.distanceUnit
+	}
+	return f.locale.number(float64(activity.AvgSpeed)*3600/f.units.distanceMeters, 2) + f.units.speedUnit
+}
+
+func (f formatter) speedLabel(activity *Activity) string {
+	if isSport(activity, swimSports) || isSport(activity, paceSports) {
+		return f.locale.text("Average Pace")
+	}
+	return f.locale.text("Average Speed")
+}
+
+// date is the activity start date, in its own timezone when known.
+func (f formatter) date(activity *Activity) string {
+	start, err := time.Parse(ACTIVITY_DATE_FORMAT, activity.StartDate)
+	if err != nil {
+		return ""
+	}
+	if loc := activityLocation(activity.Timezone); loc != nil {
+		start = start.In(loc)
+	}
+	return f.locale.date(start)
+}
+
+// DEFAULT_DESCRIPTION_TEMPLATE lists the activity figures in the feed units
+// and language.
+const DEFAULT_DESCRIPTION_TEMPLATE = `{{with .Description}}{{.}}
+
+{{end -}}
+{{t "Duration"}}: {{duration .ElapsedTime}}
+{{- if and (gt .MovingTime 0) (ne .MovingTime .ElapsedTime)}} | {{t "Moving Time"}}: {{duration .MovingTime}}{{end}}
+{{t "Distance"}}: {{distance .Distance}} | {{t "Elevation"}}: {{elevation .Elevation}}
+{{- if gt .AvgSpeed 0.0}}
+{{speedLabel .}}: {{speed .}}
+{{- end}}
+{{- if gt .AvgWatts 0.0}}
+{{t "Average Power"}}: {{number .AvgWatts 0}}W
+{{- end}}
+{{- if gt .AvgCadence 0.0}}
+{{t "Average Cadence"}}: {{number .AvgCadence 0}}rpm
+{{- end}}
+{{- if gt .AvgHeartrate 0.0}}
+{{t "Heart Rate"}}: {{number .AvgHeartrate 0}}bpm{{if gt .MaxHeartrate 0.0}} ({{t "max"}} {{number .MaxHeartrate 0}}bpm){{end}}
+{{- end}}
+{{- if gt .Calories 0.0}}
+{{t "Calories"}}: {{number .Calories 0}}kcal
+{{- end}}
+{{- if gt .SufferScore 0.0}}
+{{t "Relative Effort"}}: {{number .SufferScore 0}}
+{{- end}}
+{{- with .DeviceName}}
+{{t "Device"}}: {{.}}
+{{- end}}
+{{- with mapUrl .}}
+{{t "Map"}}: {{.}}
+{{- end}}
+{{stravaUrl .Id}}`
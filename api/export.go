@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exportRequest authenticates the athlete by the management token and
+// reads the calendar filters of the query.
+func exportRequest(w http.ResponseWriter, r *http.Request) (*StravaToken, ActivityFilter, bool) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return nil, ActivityFilter{}, false
+	}
+	filter, err := parseActivityFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, ActivityFilter{}, false
+	}
+	return token, filter, true
+}
+
+var CSV_EXPORT_COLUMNS = []string{
+	"id", "name", "sport_type", "type", "start_date", "timezone",
+	"distance", "elevation", "elapsed_time", "moving_time",
+	"average_speed", "max_speed", "average_watts", "kilojoules", "average_cadence",
+	"average_heartrate", "max_heartrate", "calories", "suffer_score",
+	"gear_id", "device_name", "commute", "trainer", "visibility",
+}
+
+func csvExportRow(a *Activity) []string {
+	start := ""
+	if date, err := time.Parse(ACTIVITY_DATE_FORMAT, a.StartDate); err == nil {
+		start = date.Format(time.RFC3339)
+	}
+	number := func(value float32) string {
+		return strconv.FormatFloat(float64(value), 'f', -1, 32)
+	}
+	return []string{
+		strconv.Itoa(a.Id), a.Name, a.SportType, a.Type, start, a.Timezone,
+		number(a.Distance), number(a.Elevation), strconv.Itoa(a.ElapsedTime), strconv.Itoa(a.MovingTime),
+		number(a.AvgSpeed), number(a.MaxSpeed), number(a.AvgWatts), number(a.Kilojoules), number(a.AvgCadence),
+		number(a.AvgHeartrate), number(a.MaxHeartrate), number(a.Calories), number(a.SufferScore),
+		a.GearId, a.DeviceName, strconv.FormatBool(a.Commute), strconv.FormatBool(a.Trainer), a.Visibility,
+	}
+}
+
+// handleExportCSV streams the activities matching the calendar filters as
+// CSV, one row per activity in SI units (meters, seconds, m/s), oldest first.
+func handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	token, filter, ok := exportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The response starts with the first activity so that a store failure
+	// before it is still reported with an error status.
+	out := csv.NewWriter(w)
+	started := false
+	start := func() {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="activities.csv"`)
+		out.Write(CSV_EXPORT_COLUMNS)
+		started = true
+	}
+	err := store.EachActivity(token.AthleteId, filter, func(activity *Activity) error {
+		if !started {
+			start()
+		}
+		return out.Write(csvExportRow(activity))
+	})
+	if err != nil && !started {
+		slog.Error("Failed to export activities", "error", err, "athlete_id", token.AthleteId)
+		http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+		return
+	}
+	if !started {
+		start()
+	}
+	out.Flush()
+	if err == nil {
+		err = out.Error()
+	}
+	if err != nil {
+		// The status is already sent, the truncated file is all we can do.
+		slog.Error("Failed to export activities", "error", err, "athlete_id", token.AthleteId)
+	}
+}
+
+// handleExportJSON streams the activities matching the calendar filters as a
+// JSON array of the stored activities, oldest first. Both exports are meant
+// for the athlete, unlike the feeds they include private activities and
+// coordinates near home as stored.
+func handleExportJSON(w http.ResponseWriter, r *http.Request) {
+	token, filter, ok := exportRequest(w, r)
+	if !ok {
+		return
+	}
+
+	separator := ""
+	start := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="activities.json"`)
+		separator = "[\n"
+	}
+	encoder := json.NewEncoder(w)
+	err := store.EachActivity(token.AthleteId, filter, func(activity *Activity) error {
+		if separator == "" {
+			start()
+		}
+		if _, err := w.Write([]byte(separator)); err != nil {
+			return err
+		}
+		separator = ","
+		return encoder.Encode(activity)
+	})
+	if err != nil {
+		slog.Error("Failed to export activities", "error", err, "athlete_id", token.AthleteId)
+		if separator == "" {
+			http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+		}
+		return
+	}
+	if separator == "" {
+		start()
+		w.Write([]byte(separator))
+	}
+	w.Write([]byte("]\n"))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Feed is a named calendar with its own filter and settings, served at
+// /feeds/{id}.ics. The id is random so the URL doubles as the secret, like the
+// athlete's feed token.
+type Feed struct {
+	Id        string         `json:"id" bson:"_id"`
+	AthleteId int            `json:"athlete_id" bson:"athlete_id"`
+	Name      string         `json:"name" bson:"name"`
+	Color     string         `json:"color,omitempty" bson:"color,omitempty"`
+	Filter    ActivityFilter `json:"filter" bson:"filter"`
+	Settings  FeedSettings   `json:"settings" bson:"settings"`
+	CreatedAt time.Time      `json:"created_at" bson:"created_at"`
+}
+
+// feedRequest is the body of POST /feeds and PUT /feeds/{id}. The filter
+// fields take the same values as the calendar query parameters.
+type feedRequest struct {
+	Name                string        `json:"name"`
+	Types               []string      `json:"types"`
+	ExcludeTypes        []string      `json:"exclude"`
+	Since               string        `json:"since"`
+	Until               string        `json:"until"`
+	MinDistance         string        `json:"min_distance"`
+	Commute             *bool         `json:"commute"`
+	Trainer             *bool         `json:"trainer"`
+	Gear                []string      `json:"gear"`
+	Privacy             string        `json:"privacy"`
+	TitleTemplate       string        `json:"title_template"`
+	DescriptionTemplate string        `json:"description_template"`
+	Units               string        `json:"units"`
+	Language            string        `json:"language"`
+	EndTime             string        `json:"end_time"`
+	FixedDuration       string        `json:"fixed_duration"`
+	Home                *HomeSettings `json:"home"`
+	Color               string        `json:"color"`
+}
+
+var feedColorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// apply validates the request and copies it onto the feed.
+func (req *feedRequest) apply(feed *Feed) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return fmt.Errorf("missing feed name")
+	}
+	if req.Color != "" && !feedColorPattern.MatchString(req.Color) {
+		return fmt.Errorf("invalid color %q, expected #RRGGBB", req.Color)
+	}
+
+	query := url.Values{
+		"type":         {strings.Join(req.Types, ",")},
+		"exclude":      {strings.Join(req.ExcludeTypes, ",")},
+		"since":        {req.Since},
+		"until":        {req.Until},
+		"min_distance": {req.MinDistance},
+		"gear":         {strings.Join(req.Gear, ",")},
+	}
+	if req.Commute != nil {
+		query.Set("commute", strconv.FormatBool(*req.Commute))
+	}
+	if req.Trainer != nil {
+		query.Set("trainer", strconv.FormatBool(*req.Trainer))
+	}
+	filter, err := parseActivityFilter(query)
+	if err != nil {
+		return err
+	}
+	settings := FeedSettings{
+		Privacy:             req.Privacy,
+		TitleTemplate:       req.TitleTemplate,
+		DescriptionTemplate: req.DescriptionTemplate,
+		Units:               req.Units,
+		Language:            req.Language,
+		EndTime:             req.EndTime,
+		FixedDuration:       req.FixedDuration,
+		Home:                req.Home,
+	}
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	feed.Name = req.Name
+	feed.Color = strings.ToUpper(req.Color)
+	feed.Filter = filter
+	feed.Settings = settings
+	return nil
+}
+
+// feedResponse adds the subscription URL to the stored feed.
+type feedResponse struct {
+	*Feed
+	CalendarUrl string `json:"calendar_url"`
+}
+
+func newFeedResponse(feed *Feed) feedResponse {
+	return feedResponse{Feed: feed, CalendarUrl: fmt.Sprintf("%s/feeds/%s.ics", APP_ADDRESS, feed.Id)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// loadOwnFeed returns the feed if it belongs to the athlete, replying 404
+// otherwise so that feed ids of other athletes can't be probed.
+func loadOwnFeed(w http.ResponseWriter, r *http.Request, athleteId int, id string) (*Feed, bool) {
+	feed, err := store.GetFeed(id)
+	if err != nil {
+		http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+		return nil, false
+	}
+	if feed == nil || feed.AthleteId != athleteId {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return feed, true
+}
+
+func handleListFeeds(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	feeds, err := store.ListFeeds(token.AthleteId)
+	if err != nil {
+		http.Error(w, "Failed to load feeds", http.StatusInternalServerError)
+		return
+	}
+	out := make([]feedResponse, 0, len(feeds))
+	for i := range feeds {
+		out = append(out, newFeedResponse(&feeds[i]))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func handleCreateFeed(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+
+	var req feedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse feed", http.StatusBadRequest)
+		return
+	}
+	feed := &Feed{Id: rand.Text(), AthleteId: token.AthleteId, CreatedAt: time.Now().UTC()}
+	if err := req.apply(feed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.SaveFeed(feed); err != nil {
+		http.Error(w, "Failed to save feed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Feed created", "athlete_id", feed.AthleteId, "feed_id", feed.Id)
+
+	writeJSON(w, http.StatusCreated, newFeedResponse(feed))
+}
+
+func handleUpdateFeed(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	feed, ok := loadOwnFeed(w, r, token.AthleteId, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	var req feedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Failed to parse feed", http.StatusBadRequest)
+		return
+	}
+	if err := req.apply(feed); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.SaveFeed(feed); err != nil {
+		http.Error(w, "Failed to save feed", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Feed updated", "athlete_id", feed.AthleteId, "feed_id", feed.Id)
+
+	writeJSON(w, http.StatusOK, newFeedResponse(feed))
+}
+
+func handleDeleteFeed(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := store.DeleteFeed(token.AthleteId, r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to delete feed", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.NotFound(w, r)
+		return
+	}
+	slog.Info("Feed deleted", "athlete_id", token.AthleteId, "feed_id", r.PathValue("id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"feed deleted"}`))
+}
+
+// handleGetFeed serves the calendar of /feeds/{id}.ics to anyone knowing the
+// id, and the feed definition of /feeds/{id} to its owner.
+func handleGetFeed(w http.ResponseWriter, r *http.Request) {
+	if id, ok := strings.CutSuffix(r.PathValue("id"), ".ics"); ok {
+		feed, err := store.GetFeed(id)
+		if err != nil {
+			http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+			return
+		}
+		if feed == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := feed.Settings.applyQuerySettings(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeCalendar(w, feed)
+		return
+	}
+
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	feed, ok := loadOwnFeed(w, r, token.AthleteId, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newFeedResponse(feed))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseTimeParam reads a query parameter given either as a unix timestamp or
+// as a YYYY-MM-DD date (midnight UTC). A missing parameter is the zero time.
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s parameter, expected a unix timestamp or YYYY-MM-DD", name)
+	}
+	return t, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// handleFetch imports the athlete's activities from Strava. Without an after
+// parameter the first fetch walks the whole history, later ones only pull
+// activities newer than the latest stored one, full=true walks the whole
+// history again. Activities are upserted so events written by the webhook in
+// the meantime are kept. The athlete is authenticated by their management
+// token since a backfill spends the shared API quota.
+func handleFetch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	owner, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	athleteId := owner.AthleteId
+	after, err := parseTimeParam(r, "after")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	before, err := parseTimeParam(r, "before")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := RefreshTokenIfExpired(athleteId)
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if token == nil {
+		http.Error(w, "Unknown athlete", http.StatusNotFound)
+		return
+	}
+
+	// The stored activities may only be the ones the webhook wrote, the
+	// history is complete once a fetch without bounds went through.
+	complete := after.IsZero() && before.IsZero()
+	if complete && !token.LastFetchAt.IsZero() && r.URL.Query().Get("full") != "true" {
+		after, err = store.LatestActivityStart(athleteId)
+		if err != nil {
+			http.Error(w, "Failed to load latest activity", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	fetchedAt := time.Now().UTC()
+	slog.Info("Starting to fetch past activities", "athlete_id", athleteId, "after", after, "before", before)
+	activities, err := strava.FetchAthleteActivities(token.AccessToken, unixOrZero(after), unixOrZero(before))
+	if err != nil {
+		slog.Error("Failed to fetch activities", "error", err, "athlete_id", athleteId)
+		http.Error(w, "Failed to fetch activities", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Successfully fetched past activities", "athlete_id", athleteId, "count", len(activities))
+
+	for i := range activities {
+		activities[i].AthleteId = athleteId
+	}
+	if err := store.UpsertActivities(activities); err != nil {
+		http.Error(w, "Failed to save activities", http.StatusInternalServerError)
+		return
+	}
+	if complete {
+		if err := store.SetLastFetch(athleteId, fetchedAt); err != nil {
+			http.Error(w, "Failed to save last fetch", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"status":"activities fetched","count":%d}`, len(activities))
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ActivityFilter selects the activities of a feed. The stores translate it
+// into their own query language so filtering never happens in memory.
+type ActivityFilter struct {
+	// Types and ExcludeTypes hold Strava sport types, matched against
+	// Activity.SportType.
+	Types        []string `json:"types,omitempty" bson:"types,omitempty"`
+	ExcludeTypes []string `json:"exclude_types,omitempty" bson:"exclude_types,omitempty"`
+	// Since is inclusive and Until exclusive, zero leaves the bound open.
+	Since time.Time `json:"since,omitzero" bson:"since,omitempty"`
+	Until time.Time `json:"until,omitzero" bson:"until,omitempty"`
+	// MinDistance is in meters.
+	MinDistance float32 `json:"min_distance,omitempty" bson:"min_distance,omitempty"`
+	// Commute and Trainer keep only the activities with the flag set, or
+	// unset when false, nil doesn't filter.
+	Commute *bool `json:"commute,omitempty" bson:"commute,omitempty"`
+	Trainer *bool `json:"trainer,omitempty" bson:"trainer,omitempty"`
+	// Gear holds Strava gear ids, e.g. b1234567.
+	Gear []string `json:"gear,omitempty" bson:"gear,omitempty"`
+}
+
+// parseActivityFilter reads the feed query parameters, e.g.
+// ?type=Ride,GravelRide&exclude=VirtualRide&since=2025-01-01&until=2025-12-31&min_distance=5km
+// &commute=false&trainer=false&gear=b1234567
+// Types use the Strava sport_type names, dates are YYYY-MM-DD (until is
+// inclusive) and distances accept the m, km and mi units, meters by default.
+func parseActivityFilter(q url.Values) (ActivityFilter, error) {
+	var filter ActivityFilter
+	filter.Types = parseTypeList(q.Get("type"))
+	filter.ExcludeTypes = parseTypeList(q.Get("exclude"))
+
+	var err error
+	if since := q.Get("since"); since != "" {
+		filter.Since, err = time.Parse(time.DateOnly, since)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since parameter, expected YYYY-MM-DD")
+		}
+	}
+	if until := q.Get("until"); until != "" {
+		filter.Until, err = time.Parse(time.DateOnly, until)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until parameter, expected YYYY-MM-DD")
+		}
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	if minDistance := q.Get("min_distance"); minDistance != "" {
+		filter.MinDistance, err = parseDistance(minDistance)
+		if err != nil {
+			return filter, fmt.Errorf("invalid min_distance parameter: %w", err)
+		}
+	}
+	if filter.Commute, err = parseFlagParam(q, "commute"); err != nil {
+		return filter, err
+	}
+	if filter.Trainer, err = parseFlagParam(q, "trainer"); err != nil {
+		return filter, err
+	}
+	filter.Gear = parseList(q.Get("gear"))
+	return filter, nil
+}
+
+func parseFlagParam(q url.Values, name string) (*bool, error) {
+	value := q.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter, expected true or false", name)
+	}
+	return &flag, nil
+}
+
+func parseList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseTypeList(value string) []string {
+	types := parseList(value)
+	for i, t := range types {
+		types[i] = activityTypeFromName(t)
+	}
+	return types
+}
+
+// parseDistance converts a distance such as "5km", "500m" or "3mi" to meters.
+func parseDistance(value string) (float32, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	factor := 1.0
+	for _, unit := range []struct {
+		suffix string
+		factor float64
+	}{{"km", 1000}, {"mi", 1609.344}, {"m", 1}} {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			value = strings.TrimSpace(number)
+			factor = unit.factor
+			break
+		}
+	}
+	distance, err := strconv.ParseFloat(value, 32)
+	if err != nil || distance < 0 {
+		return 0, fmt.Errorf("expected a positive distance such as 5km, 500m or 3mi")
+	}
+	return float32(distance * factor), nil
+}
+
+// migrateTypes converts the English display names of a filter saved before
+// the sport types were stored, reporting whether there were any.
+func (f *ActivityFilter) migrateTypes() bool {
+	migrated := false
+	for _, types := range [][]string{f.Types, f.ExcludeTypes} {
+		for i, t := range types {
+			if sportType := activityTypeFromName(t); sportType != t {
+				types[i] = sportType
+				migrated = true
+			}
+		}
+	}
+	return migrated
+}
+
+func (f ActivityFilter) IsEmpty() bool {
+	return len(f.Types) == 0 && len(f.ExcludeTypes) == 0 && f.Since.IsZero() && f.Until.IsZero() && f.MinDistance == 0 &&
+		f.Commute == nil && f.Trainer == nil && len(f.Gear) == 0
+}
+
+// Matches is the in-memory equivalent of the store queries.
+func (f ActivityFilter) Matches(a *Activity) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, a.SportType) {
+		return false
+	}
+	if slices.Contains(f.ExcludeTypes, a.SportType) {
+		return false
+	}
+	if !f.Since.IsZero() && a.StartDate < f.Since.UTC().Format(ACTIVITY_DATE_FORMAT) {
+		return false
+	}
+	if !f.Until.IsZero() && a.StartDate >= f.Until.UTC().Format(ACTIVITY_DATE_FORMAT) {
+		return false
+	}
+	if f.Commute != nil && a.Commute != *f.Commute {
+		return false
+	}
+	if f.Trainer != nil && a.Trainer != *f.Trainer {
+		return false
+	}
+	if len(f.Gear) > 0 && !slices.Contains(f.Gear, a.GearId) {
+		return false
+	}
+	return a.Distance >= f.MinDistance
+}
+
+// Describe summarizes the filter for the calendar name, e.g.
+// "Ride, Gravel Ride, since June 1, 2025, 5 km or more".
+func (f ActivityFilter) Describe(loc *locale) string {
+	var parts []string
+	if len(f.Types) > 0 {
+		parts = append(parts, loc.typeNameList(f.Types))
+	}
+	if len(f.ExcludeTypes) > 0 {
+		parts = append(parts, loc.textf("excluding %s", loc.typeNameList(f.ExcludeTypes)))
+	}
+	if !f.Since.IsZero() {
+		parts = append(parts, loc.textf("since %s", loc.date(f.Since)))
+	}
+	if !f.Until.IsZero() {
+		parts = append(parts, loc.textf("until %s", loc.date(f.Until.AddDate(0, 0, -1))))
+	}
+	if f.MinDistance > 0 {
+		distance := strconv.FormatFloat(float64(f.MinDistance)/1000, 'f', -1, 32)
+		parts = append(parts, loc.textf("%s or more", strings.Replace(distance, ".", loc.decimal, 1)+" km"))
+	}
+	if f.Commute != nil && *f.Commute {
+		parts = append(parts, loc.text("commutes only"))
+	} else if f.Commute != nil {
+		parts = append(parts, loc.text("no commutes"))
+	}
+	if f.Trainer != nil && *f.Trainer {
+		parts = append(parts, loc.text("indoor only"))
+	} else if f.Trainer != nil {
+		parts = append(parts, loc.text("no indoor"))
+	}
+	if len(f.Gear) > 0 {
+		parts = append(parts, loc.textf("gear %s", strings.Join(f.Gear, ", ")))
+	}
+	return strings.Join(parts, ", ")
+}
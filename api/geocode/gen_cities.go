@@ -0,0 +1,87 @@
+//go:build ignore
+
+// gen_cities writes the bundled extract, data/cities1000.tsv.gz, in the
+// layout Load reads: name, country code, latitude and longitude. It reads
+// the cities.json list of lutangar/cities.json, the GeoNames cities of more
+// than 1,000 inhabitants, from the -source file or URL. See data/NOTICE for
+// the license.
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	DEFAULT_SOURCE = "https://raw.githubusercontent.com/lutangar/cities.json/master/cities.json"
+	OUTPUT         = "data/cities1000.tsv.gz"
+)
+
+type city struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+	Lat     string `json:"lat"`
+	Lng     string `json:"lng"`
+}
+
+func open(source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "https://") && !strings.HasPrefix(source, "http://") {
+		return os.Open(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: status code %d", source, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+func main() {
+	source := flag.String("source", DEFAULT_SOURCE, "path or URL of cities.json")
+	flag.Parse()
+
+	in, err := open(*source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	var cities []city
+	if err := json.NewDecoder(in).Decode(&cities); err != nil {
+		log.Fatal(err)
+	}
+
+	out, err := os.Create(OUTPUT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+	gz, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(gz)
+	for _, c := range cities {
+		if strings.ContainsAny(c.Name, "\t\n") {
+			log.Fatalf("unexpected separator in %q", c.Name)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Country, c.Lat, c.Lng)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d cities to %s", len(cities), OUTPUT)
+}
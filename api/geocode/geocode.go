@@ -0,0 +1,161 @@
+// Package geocode resolves coordinates to the nearest city without any
+// outside service.
+//
+// The bundled data/cities1000.tsv.gz lists the GeoNames cities of more than
+// 1,000 inhabitants as tab separated name, ISO 3166 country code, latitude
+// and longitude. It is extracted by gen_cities.go and licensed under CC BY
+// 4.0, see data/NOTICE. Load also reads the GeoNames dumps themselves, e.g.
+// cities500.txt for a denser coverage.
+package geocode
+
+//go:generate go run gen_cities.go
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//go:embed data/cities1000.tsv.gz
+var bundledCities []byte
+
+const EARTH_RADIUS = 6371000
+
+// GEONAMES_COLUMNS is the column count of the GeoNames "geoname" table dumps.
+const GEONAMES_COLUMNS = 19
+
+type Place struct {
+	Name    string
+	Country string
+	Lat     float64
+	Lng     float64
+}
+
+func (p Place) String() string {
+	if p.Country == "" {
+		return p.Name
+	}
+	return p.Name + ", " + p.Country
+}
+
+// Load reads places from the bundled layout (name, country, latitude,
+// longitude) or from a GeoNames dump, telling them apart by the column
+// count. GeoNames countries are ISO 3166 codes.
+func Load(r io.Reader) ([]Place, error) {
+	var places []Place
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		var name, country, lat, lng string
+		switch len(fields) {
+		case 4:
+			name, country, lat, lng = fields[0], fields[1], fields[2], fields[3]
+		case GEONAMES_COLUMNS:
+			name, country, lat, lng = fields[1], fields[8], fields[4], fields[5]
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %d columns", line, len(fields))
+		}
+		place := Place{Name: name, Country: country}
+		var err error
+		if place.Lat, err = strconv.ParseFloat(lat, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude: %w", line, err)
+		}
+		if place.Lng, err = strconv.ParseFloat(lng, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude: %w", line, err)
+		}
+		places = append(places, place)
+	}
+	return places, scanner.Err()
+}
+
+// Bundled returns the places of the bundled dataset.
+func Bundled() ([]Place, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(bundledCities))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return Load(gz)
+}
+
+// cell is a one degree square of the grid index.
+type cell struct {
+	lat, lng int
+}
+
+func cellOf(lat, lng float64) cell {
+	return cell{int(math.Floor(lat)), int(math.Floor(lng))}
+}
+
+// Geocoder finds the nearest place, indexing the places on a one degree grid
+// so that a lookup only looks at the surrounding cells.
+type Geocoder struct {
+	cells map[cell][]Place
+}
+
+func New(places []Place) *Geocoder {
+	g := &Geocoder{cells: make(map[cell][]Place)}
+	for _, place := range places {
+		c := cellOf(place.Lat, place.Lng)
+		g.cells[c] = append(g.cells[c], place)
+	}
+	return g
+}
+
+var bundled = sync.OnceValues(func() (*Geocoder, error) {
+	places, err := Bundled()
+	if err != nil {
+		return nil, err
+	}
+	return New(places), nil
+})
+
+// Default returns the geocoder of the bundled dataset, loaded on first use.
+func Default() (*Geocoder, error) {
+	return bundled()
+}
+
+// Nearest returns the place closest to the coordinates, if any is within
+// maxDistance meters. maxDistance is capped to about 100 km, the cells
+// searched around the coordinates.
+func (g *Geocoder) Nearest(lat, lng, maxDistance float64) (Place, bool) {
+	var nearest Place
+	found := false
+	center := cellOf(lat, lng)
+	for dLat := -1; dLat <= 1; dLat++ {
+		for dLng := -1; dLng <= 1; dLng++ {
+			c := cell{center.lat + dLat, wrapLng(center.lng + dLng)}
+			for _, place := range g.cells[c] {
+				if distance := Distance(lat, lng, place.Lat, place.Lng); distance <= maxDistance {
+					nearest, maxDistance, found = place, distance, true
+				}
+			}
+		}
+	}
+	return nearest, found
+}
+
+// wrapLng keeps grid longitudes in [-180, 180) across the antimeridian.
+func wrapLng(lng int) int {
+	return (lng+540)%360 - 180
+}
+
+// Distance is the great circle distance between two points in meters.
+func Distance(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,128 @@
+package ical
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Calendar is a VCALENDAR object.
+type Calendar struct {
+	ProdId string
+	// Name is the calendar display name (X-WR-CALNAME), optional.
+	Name       string
+	Properties []Property
+	Timezones  []*Timezone
+	Events     []Event
+}
+
+// Event is a VEVENT component. Start and End are written as local times of
+// TZ, which must then be listed in the calendar Timezones, or in UTC when TZ
+// is nil.
+type Event struct {
+	UID         string
+	Stamp       time.Time
+	Start       time.Time
+	End         time.Time
+	TZ          *time.Location
+	Summary     string
+	Description string
+	// Class is the access classification, e.g. PRIVATE, optional.
+	Class string
+	// Location and Geo are optional.
+	Location   string
+	Geo        *Geo
+	Properties []Property
+}
+
+// Geo is a GEO position in decimal degrees.
+type Geo struct {
+	Lat, Lng float64
+}
+
+// Encode writes the calendar and all its events.
+func (c *Calendar) Encode(w io.Writer) error {
+	enc := NewEncoder(w)
+	enc.Begin(c)
+	for i := range c.Events {
+		enc.Event(&c.Events[i])
+	}
+	return enc.End()
+}
+
+// Encoder streams a calendar: Begin writes the calendar properties and
+// timezones, events follow one by one, End closes the calendar and flushes.
+type Encoder struct {
+	w *Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: NewWriter(w)}
+}
+
+func (e *Encoder) Begin(c *Calendar) {
+	e.w.Begin("VCALENDAR")
+	e.w.Property(Property{Name: "VERSION", Value: "2.0"})
+	e.w.Property(TextProperty("PRODID", c.ProdId))
+	if c.Name != "" {
+		e.w.Property(TextProperty("X-WR-CALNAME", c.Name))
+	}
+	for _, p := range c.Properties {
+		e.w.Property(p)
+	}
+	for _, tz := range c.Timezones {
+		tz.encode(e.w)
+	}
+}
+
+func (e *Encoder) Event(ev *Event) {
+	e.w.Begin("VEVENT")
+	e.w.Property(TextProperty("UID", ev.UID))
+	e.w.Property(DateTimeProperty("DTSTAMP", ev.Stamp, nil))
+	e.w.Property(DateTimeProperty("DTSTART", ev.Start, ev.TZ))
+	e.w.Property(DateTimeProperty("DTEND", ev.End, ev.TZ))
+	e.w.Property(TextProperty("SUMMARY", ev.Summary))
+	if ev.Description != "" {
+		e.w.Property(TextProperty("DESCRIPTION", ev.Description))
+	}
+	if ev.Class != "" {
+		e.w.Property(Property{Name: "CLASS", Value: ev.Class})
+	}
+	if ev.Location != "" {
+		e.w.Property(TextProperty("LOCATION", ev.Location))
+	}
+	if ev.Geo != nil {
+		e.w.Property(Property{Name: "GEO", Value: fmt.Sprintf("%s;%s", formatFloat(ev.Geo.Lat), formatFloat(ev.Geo.Lng))})
+	}
+	for _, p := range ev.Properties {
+		e.w.Property(p)
+	}
+	e.w.End("VEVENT")
+}
+
+// End closes the calendar and returns the first error of the whole encoding.
+func (e *Encoder) End() error {
+	e.w.End("VCALENDAR")
+	return e.w.Flush()
+}
+
+func formatFloat(degrees float64) string {
+	return strconv.FormatFloat(degrees, 'f', -1, 64)
+}
+
+// StructuredLocationProperty is the Apple extension carrying the position
+// with the location title, which Apple Calendar shows as a map. radius in
+// meters is how precise the position is, zero leaves it out.
+func StructuredLocationProperty(title string, geo Geo, radius float64) Property {
+	params := []Param{{Name: "VALUE", Value: "URI"}}
+	if radius > 0 {
+		params = append(params, Param{Name: "X-APPLE-RADIUS", Value: formatFloat(radius)})
+	}
+	params = append(params, Param{Name: "X-TITLE", Value: title})
+	return Property{
+		Name:   "X-APPLE-STRUCTURED-LOCATION",
+		Params: params,
+		Value:  fmt.Sprintf("geo:%s,%s", formatFloat(geo.Lat), formatFloat(geo.Lng)),
+	}
+}
@@ -0,0 +1,191 @@
+package ical
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// assertGolden compares the output with testdata/name, which -update rewrites.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// assertContentLines checks every line is CRLF terminated, at most
+// MAX_LINE_OCTETS long and valid UTF-8, i.e. no sequence was split by the
+// folding.
+func assertContentLines(t *testing.T, out []byte) {
+	t.Helper()
+	if !bytes.HasSuffix(out, []byte("\r\n")) {
+		t.Fatalf("output doesn't end with CRLF")
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(string(out), "\r\n"), "\r\n") {
+		if strings.ContainsAny(line, "\r\n") {
+			t.Errorf("line %d has a bare line break: %q", i+1, line)
+		}
+		if len(line) > MAX_LINE_OCTETS {
+			t.Errorf("line %d is %d octets long: %q", i+1, len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line %d splits a UTF-8 sequence: %q", i+1, line)
+		}
+	}
+}
+
+func unfold(out []byte) string {
+	return strings.ReplaceAll(string(out), "\r\n ", "")
+}
+
+func writeProperties(t *testing.T, properties ...Property) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, p := range properties {
+		w.Property(p)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFolding(t *testing.T) {
+	properties := []Property{
+		// "SUMMARY:" is 8 octets, the 34th é straddles the 75th octet.
+		TextProperty("SUMMARY", strings.Repeat("é", 80)),
+		// 4 octet runes, the boundaries fall inside them on every line.
+		TextProperty("DESCRIPTION", "Sortie "+strings.Repeat("🚴", 40)),
+		TextProperty("LOCATION", strings.Repeat("東京", 30)),
+		// Exactly 75 octets, not folded.
+		TextProperty("SUMMARY", strings.Repeat("a", MAX_LINE_OCTETS-len("SUMMARY:"))),
+	}
+	out := writeProperties(t, properties...)
+	assertContentLines(t, out)
+
+	var want strings.Builder
+	for _, p := range properties {
+		want.WriteString(p.Name + ":" + p.Value + "\r\n")
+	}
+	if got := unfold(out); got != want.String() {
+		t.Errorf("unfolded output differs from the properties\ngot:  %q\nwant: %q", got, want.String())
+	}
+	assertGolden(t, "fold.ics", out)
+}
+
+func TestEscapeText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Morning Ride", "Morning Ride"},
+		{"a;b", `a\;b`},
+		{"a,b", `a\,b`},
+		{`C:\Users`, `C:\\Users`},
+		{"a\nb", `a\nb`},
+		{"a\r\nb", `a\nb`},
+		{"a\rb", `a\nb`},
+		{"a\n\rb", `a\n\nb`},
+		{`\;,`, `\\\;\,`},
+	}
+	for _, test := range tests {
+		if got := EscapeText(test.in); got != test.want {
+			t.Errorf("EscapeText(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	out := writeProperties(t,
+		TextProperty("SUMMARY", "Run; easy, then hard"),
+		TextProperty("DESCRIPTION", "Line 1\r\nLine 2\rLine 3\nLine 4"),
+		TextProperty("COMMENT", `Path C:\tracks\ride.gpx`),
+	)
+	assertContentLines(t, out)
+	assertGolden(t, "escape.ics", out)
+}
+
+func TestParams(t *testing.T) {
+	out := writeProperties(t,
+		Property{
+			Name:   "ATTACH",
+			Params: []Param{{Name: "FMTTYPE", Value: "image/png"}},
+			Value:  "https://example.com/map.png",
+		},
+		// Values with a colon, semicolon or comma are quoted.
+		TextProperty("LOCATION", "Paris", Param{Name: "ALTREP", Value: "https://example.com/paris"}),
+		TextProperty("ATTENDEE", "x", Param{Name: "CN", Value: "Doe; John"}, Param{Name: "X-TEAM", Value: "A,B"}),
+		// DQUOTE and control characters can't be represented.
+		TextProperty("COMMENT", "x", Param{Name: "X-NOTE", Value: "say \"hi\"\x01\ttab"}),
+		StructuredLocationProperty("Paris, FR", Geo{Lat: 48.8566, Lng: 2.3522}, 1000),
+		DateTimeProperty("DTSTART", time.Date(2025, 6, 1, 9, 0, 0, 0, time.FixedZone("CEST", 2*3600)), nil),
+	)
+	assertContentLines(t, out)
+	assertGolden(t, "params.ics", out)
+}
+
+func TestTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	calendar := &Calendar{ProdId: "-//strava2cal//test//EN", Name: "Strava"}
+	tz := NewTimezone(paris)
+	calendar.Timezones = append(calendar.Timezones, tz)
+
+	// Around the switch to summer time on 2025-03-30 and back to winter time
+	// on 2025-10-26.
+	starts := []time.Time{
+		time.Date(2025, 3, 29, 9, 0, 0, 0, paris),
+		time.Date(2025, 3, 30, 9, 0, 0, 0, paris),
+		time.Date(2025, 10, 26, 9, 0, 0, 0, paris),
+	}
+	for i, start := range starts {
+		end := start.Add(90 * time.Minute)
+		tz.Add(start, end)
+		calendar.Events = append(calendar.Events, Event{
+			UID:     "ride-" + string(rune('a'+i)) + "@strava2cal",
+			Stamp:   stamp,
+			Start:   start,
+			End:     end,
+			TZ:      paris,
+			Summary: "Ride",
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := calendar.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.Bytes()
+	assertContentLines(t, out)
+	for _, want := range []string{
+		"BEGIN:STANDARD\r\nDTSTART:20241027T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\n",
+		"BEGIN:DAYLIGHT\r\nDTSTART:20250330T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\n",
+		"BEGIN:STANDARD\r\nDTSTART:20251026T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\n",
+		"DTSTART;TZID=Europe/Paris:20250330T090000\r\n",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("calendar is missing %q", want)
+		}
+	}
+	assertGolden(t, "vtimezone_paris.ics", out)
+}
@@ -0,0 +1,85 @@
+package ical
+
+import (
+	"fmt"
+	"time"
+)
+
+// Timezone is a VTIMEZONE built from the Go tz database. It only lists the
+// offset changes between From and To, the period covered by the events using
+// it.
+type Timezone struct {
+	Location *time.Location
+	From, To time.Time
+}
+
+func NewTimezone(loc *time.Location) *Timezone {
+	return &Timezone{Location: loc}
+}
+
+// Add extends the covered period to include an event.
+func (tz *Timezone) Add(start, end time.Time) {
+	if tz.From.IsZero() || start.Before(tz.From) {
+		tz.From = start
+	}
+	if end.After(tz.To) {
+		tz.To = end
+	}
+}
+
+// encode writes one observance per offset change, starting with the one in
+// effect at From.
+func (tz *Timezone) encode(w *Writer) {
+	w.Begin("VTIMEZONE")
+	w.Property(Property{Name: "TZID", Value: tz.Location.String()})
+
+	t := tz.From.In(tz.Location)
+	for {
+		start, end := t.ZoneBounds()
+		encodeObservance(w, t, start)
+		if end.IsZero() || end.After(tz.To) {
+			break
+		}
+		t = end
+	}
+
+	w.End("VTIMEZONE")
+}
+
+// encodeObservance describes the zone in effect at t, which took effect at
+// start (zero when it has always been in effect).
+func encodeObservance(w *Writer, t, start time.Time) {
+	name, offsetTo := t.Zone()
+	offsetFrom := offsetTo
+	onset := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !start.IsZero() {
+		_, offsetFrom = start.Add(-time.Second).Zone()
+		// DTSTART is the wall clock time right before the transition.
+		onset = start.UTC().Add(time.Duration(offsetFrom) * time.Second)
+	}
+
+	component := "STANDARD"
+	if t.IsDST() {
+		component = "DAYLIGHT"
+	}
+
+	w.Begin(component)
+	w.Property(Property{Name: "DTSTART", Value: onset.Format(DATE_TIME_LOCAL_FORMAT)})
+	w.Property(Property{Name: "TZOFFSETFROM", Value: formatUTCOffset(offsetFrom)})
+	w.Property(Property{Name: "TZOFFSETTO", Value: formatUTCOffset(offsetTo)})
+	w.Property(TextProperty("TZNAME", name))
+	w.End(component)
+}
+
+func formatUTCOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	out := fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+	if seconds%60 != 0 {
+		out += fmt.Sprintf("%02d", seconds%60)
+	}
+	return out
+}
@@ -0,0 +1,153 @@
+// Package ical encodes RFC 5545 iCalendar data.
+package ical
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// MAX_LINE_OCTETS is the longest a content line may be, excluding the CRLF.
+const MAX_LINE_OCTETS = 75
+
+const (
+	DATE_TIME_UTC_FORMAT   = "20060102T150405Z"
+	DATE_TIME_LOCAL_FORMAT = "20060102T150405"
+)
+
+// Param is a property parameter such as TZID=Europe/Paris.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Property is a content line. Value is written as is, use the constructors
+// to get a correctly escaped value.
+type Property struct {
+	Name   string
+	Params []Param
+	Value  string
+}
+
+// TextProperty returns a property with a TEXT value.
+func TextProperty(name, text string, params ...Param) Property {
+	return Property{Name: name, Params: params, Value: EscapeText(text)}
+}
+
+// DateTimeProperty returns a DATE-TIME property, in UTC when loc is nil and
+// as a local time with a TZID parameter otherwise.
+func DateTimeProperty(name string, t time.Time, loc *time.Location) Property {
+	if loc == nil {
+		return Property{Name: name, Value: t.UTC().Format(DATE_TIME_UTC_FORMAT)}
+	}
+	return Property{
+		Name:   name,
+		Params: []Param{{Name: "TZID", Value: loc.String()}},
+		Value:  t.In(loc).Format(DATE_TIME_LOCAL_FORMAT),
+	}
+}
+
+var textEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+// EscapeText escapes a TEXT value: backslashes, semicolons and commas are
+// backslash escaped and every line break becomes \n.
+func EscapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+// escapeParamValue quotes the value when it contains a delimiter. DQUOTE and
+// control characters can't be represented and are dropped.
+func escapeParamValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '"' || (r < 0x20 && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	if strings.ContainsAny(s, ":;,") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// Writer writes content lines, folding them at MAX_LINE_OCTETS without ever
+// splitting a UTF-8 sequence. The first error is kept and returned by Flush,
+// later writes are no-ops.
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Begin opens a component, e.g. VEVENT.
+func (w *Writer) Begin(component string) {
+	w.Property(Property{Name: "BEGIN", Value: component})
+}
+
+// End closes a component.
+func (w *Writer) End(component string) {
+	w.Property(Property{Name: "END", Value: component})
+}
+
+func (w *Writer) Property(p Property) {
+	var line strings.Builder
+	line.WriteString(p.Name)
+	for _, param := range p.Params {
+		line.WriteByte(';')
+		line.WriteString(param.Name)
+		line.WriteByte('=')
+		line.WriteString(escapeParamValue(param.Value))
+	}
+	line.WriteByte(':')
+	line.WriteString(p.Value)
+	w.writeLine(line.String())
+}
+
+func (w *Writer) writeLine(line string) {
+	if w.err != nil {
+		return
+	}
+	// The first line holds MAX_LINE_OCTETS octets, continuation lines one
+	// less to make room for the leading space.
+	limit := MAX_LINE_OCTETS
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.write(line[:cut])
+		w.write("\r\n ")
+		line = line[cut:]
+		limit = MAX_LINE_OCTETS - 1
+	}
+	w.write(line)
+	w.write("\r\n")
+}
+
+func (w *Writer) write(s string) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.WriteString(s)
+}
+
+// Flush writes any buffered data and returns the first error encountered.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCHIVE_DATE_FORMAT is the layout of the UTC dates of the activities.csv of
+// a Strava bulk export, e.g. "Jan 2, 2023, 7:14:33 AM".
+const ARCHIVE_DATE_FORMAT = "Jan 2, 2006, 3:04:05 PM"
+
+const (
+	// MAX_ARCHIVE_MEMORY is the part of an uploaded archive kept in memory,
+	// the rest is spooled to a temporary file.
+	MAX_ARCHIVE_MEMORY = 32 << 20
+	// MAX_ARCHIVE_UPLOAD bounds the upload, FIT and GPX files included.
+	MAX_ARCHIVE_UPLOAD = 1 << 30
+	// MAX_ACTIVITIES_CSV_SIZE bounds the decompressed activities.csv, about
+	// a kilobyte per activity.
+	MAX_ACTIVITIES_CSV_SIZE = 256 << 20
+)
+
+// IMPORT_VISIBILITIES are the visibilities imported activities may be given,
+// the archive doesn't tell them. DEFAULT_IMPORT_VISIBILITY keeps them out of
+// the feeds until a webhook update or a /fetch brings the real one.
+var IMPORT_VISIBILITIES = []string{"only_me", "followers_only", "everyone"}
+
+const DEFAULT_IMPORT_VISIBILITY = "only_me"
+
+func validateImportVisibility(visibility string) error {
+	if !slices.Contains(IMPORT_VISIBILITIES, visibility) {
+		return fmt.Errorf("invalid visibility %q, expected one of %s", visibility, strings.Join(IMPORT_VISIBILITIES, ", "))
+	}
+	return nil
+}
+
+var errActivitiesCSVTooLarge = fmt.Errorf("activities.csv is larger than %d bytes", MAX_ACTIVITIES_CSV_SIZE)
+
+// sizeLimitedReader fails with err once more than n bytes were read.
+type sizeLimitedReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, l.err
+	}
+	return n, err
+}
+
+// importReport tells what an archive import did. Errors lists the rows that
+// couldn't be read, by activity id or line.
+type importReport struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	// Visibility is the one the imported activities were given.
+	Visibility string   `json:"visibility"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// archiveError marks an archive that can't be imported, as opposed to a
+// failure of the store.
+type archiveError struct {
+	err error
+}
+
+func (e archiveError) Error() string {
+	return e.err.Error()
+}
+
+func (e archiveError) Unwrap() error {
+	return e.err
+}
+
+// archiveRow reads the activities.csv columns by name. Some columns appear
+// twice: first in the summary, Distance being in the athlete's units (km or
+// mi), then in the details in SI units.
+type archiveRow struct {
+	columns map[string][]int
+	record  []string
+}
+
+func (r archiveRow) field(index int) string {
+	if index >= len(r.record) {
+		return ""
+	}
+	return strings.TrimSpace(r.record[index])
+}
+
+// get reads the first column of the name.
+func (r archiveRow) get(name string) string {
+	indexes := r.columns[name]
+	if len(indexes) == 0 {
+		return ""
+	}
+	return r.field(indexes[0])
+}
+
+// number reads an optional figure, 0 when missing or unreadable.
+func (r archiveRow) number(name string) float32 {
+	value, _ := strconv.ParseFloat(r.get(name), 32)
+	return float32(value)
+}
+
+// siNumber reads the SI figure of a column repeated in the details, 0 when
+// the archive has no such column or leaves it empty.
+func (r archiveRow) siNumber(name string) float32 {
+	indexes := r.columns[name]
+	if len(indexes) < 2 {
+		return 0
+	}
+	value, _ := strconv.ParseFloat(r.field(indexes[len(indexes)-1]), 32)
+	return float32(value)
+}
+
+func (r archiveRow) activity(athleteId int) (*Activity, error) {
+	id, err := strconv.Atoi(r.get("Activity ID"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid activity id %q", r.get("Activity ID"))
+	}
+	// Recent exports put a narrow no-break space before AM/PM.
+	date := strings.ReplaceAll(r.get("Activity Date"), "\u202f", " ")
+	start, err := time.Parse(ARCHIVE_DATE_FORMAT, date)
+	if err != nil {
+		return nil, fmt.Errorf("activity %d: invalid date %q", id, date)
+	}
+	typeName := r.get("Activity Type")
+	if typeName == "" {
+		return nil, fmt.Errorf("activity %d: missing type", id)
+	}
+	// The archive has the English display names, e.g. "Weight Training".
+	sportType := strings.ReplaceAll(activityTypeFromName(typeName), " ", "")
+	commute, _ := strconv.ParseBool(r.get("Commute"))
+
+	return &Activity{
+		BaseActivity: BaseActivity{
+			Id:           id,
+			Name:         r.get("Activity Name"),
+			Description:  r.get("Activity Description"),
+			Distance:     r.siNumber("Distance"),
+			Elevation:    r.number("Elevation Gain"),
+			ElapsedTime:  int(r.number("Elapsed Time")),
+			MovingTime:   int(r.number("Moving Time")),
+			AvgSpeed:     r.number("Average Speed"),
+			MaxSpeed:     r.number("Max Speed"),
+			AvgWatts:     r.number("Average Watts"),
+			AvgCadence:   r.number("Average Cadence"),
+			AvgHeartrate: r.number("Average Heart Rate"),
+			MaxHeartrate: r.number("Max Heart Rate"),
+			Calories:     r.number("Calories"),
+			SufferScore:  r.number("Relative Effort"),
+			Commute:      commute,
+		},
+		AthleteId: athleteId,
+		SportType: sportType,
+		Type:      legacyActivityType(sportType),
+		StartDate: start.UTC().Format(ACTIVITY_DATE_FORMAT),
+	}, nil
+}
+
+// parseArchiveActivities reads the activities.csv of a Strava bulk export.
+// Rows that can't be read are reported in the errors rather than failing
+// the whole file.
+func parseArchiveActivities(r io.Reader, athleteId int) ([]Activity, []string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read activities.csv header: %w", err)
+	}
+	columns := make(map[string][]int)
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		columns[name] = append(columns[name], i)
+	}
+	if _, ok := columns["Activity ID"]; !ok {
+		return nil, nil, errors.New("activities.csv has no Activity ID column")
+	}
+
+	var activities []Activity
+	var rowErrors []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read activities.csv: %w", err)
+		}
+		activity, err := archiveRow{columns: columns, record: record}.activity(athleteId)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			rowErrors = append(rowErrors, fmt.Sprintf("line %d: %s", line, err))
+			continue
+		}
+		activities = append(activities, *activity)
+	}
+	return activities, rowErrors, nil
+}
+
+// importArchive imports the activities of a Strava "Download your data"
+// archive for the athlete, keeping the Strava ids so that later webhook
+// events update them. Activities already stored are skipped, the API copy
+// being more complete. The archive doesn't tell the visibility, the
+// timezone nor the route of the activities, they are imported with the
+// given visibility, in UTC and without a map. Archives that can't be read
+// fail with an archiveError.
+func importArchive(athleteId int, archive *zip.Reader, visibility string) (*importReport, error) {
+	var file *zip.File
+	for _, f := range archive.File {
+		if path.Base(f.Name) == "activities.csv" {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return nil, archiveError{errors.New("archive has no activities.csv")}
+	}
+	if file.UncompressedSize64 > MAX_ACTIVITIES_CSV_SIZE {
+		return nil, archiveError{errActivitiesCSVTooLarge}
+	}
+	content, err := file.Open()
+	if err != nil {
+		return nil, archiveError{err}
+	}
+	defer content.Close()
+	// The zip header may lie about the size.
+	limited := &sizeLimitedReader{r: content, n: MAX_ACTIVITIES_CSV_SIZE, err: errActivitiesCSVTooLarge}
+	activities, rowErrors, err := parseArchiveActivities(limited, athleteId)
+	if err != nil {
+		return nil, archiveError{err}
+	}
+
+	report := &importReport{Visibility: visibility, Errors: rowErrors}
+	var imported []Activity
+	for _, activity := range activities {
+		activity.Visibility = visibility
+		existing, err := store.GetActivity(athleteId, activity.Id)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			report.Skipped++
+			continue
+		}
+		imported = append(imported, activity)
+	}
+	if len(imported) > 0 {
+		if err := store.UpsertActivities(imported); err != nil {
+			return nil, err
+		}
+	}
+	report.Imported = len(imported)
+	return report, nil
+}
+
+// runImport is the import command:
+// strava2cal import --archive export.zip --athlete 12345 [--visibility everyone]
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	archivePath := flags.String("archive", "", "path of the Strava bulk export zip")
+	athleteId := flags.Int("athlete", 0, "Strava id of the athlete the archive belongs to")
+	visibility := flags.String("visibility", DEFAULT_IMPORT_VISIBILITY,
+		"visibility given to the imported activities, one of "+strings.Join(IMPORT_VISIBILITIES, ", "))
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *archivePath == "" || *athleteId == 0 {
+		flags.Usage()
+		return errors.New("--archive and --athlete are required")
+	}
+	if err := validateImportVisibility(*visibility); err != nil {
+		return err
+	}
+
+	archive, err := zip.OpenReader(*archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	report, err := importArchive(*athleteId, &archive.Reader, *visibility)
+	if err != nil {
+		return err
+	}
+	for _, rowError := range report.Errors {
+		fmt.Fprintln(os.Stderr, rowError)
+	}
+	fmt.Printf("Imported %d activities with visibility %s, skipped %d already stored, %d unreadable\n",
+		report.Imported, report.Visibility, report.Skipped, len(report.Errors))
+	return nil
+}
+
+// handleImportArchive imports the archive uploaded in the "archive" field of
+// a multipart form for the athlete of the management token. The optional
+// "visibility" field is the one given to the activities, see
+// DEFAULT_IMPORT_VISIBILITY.
+func handleImportArchive(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_ARCHIVE_UPLOAD)
+	if err := r.ParseMultipartForm(MAX_ARCHIVE_MEMORY); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Archive too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = DEFAULT_IMPORT_VISIBILITY
+	}
+	if err := validateImportVisibility(visibility); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("archive")
+	if err != nil {
+		http.Error(w, "Missing archive", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	archive, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		http.Error(w, "Invalid zip archive", http.StatusBadRequest)
+		return
+	}
+
+	report, err := importArchive(token.AthleteId, archive, visibility)
+	var invalid archiveError
+	if errors.As(err, &invalid) {
+		http.Error(w, "Invalid archive: "+invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to import archive", "error", err, "athlete_id", token.AthleteId)
+		http.Error(w, "Failed to import archive", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Archive imported", "athlete_id", token.AthleteId, "imported", report.Imported, "skipped", report.Skipped, "visibility", report.Visibility)
+	writeJSON(w, http.StatusOK, report)
+}
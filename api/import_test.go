@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ARCHIVE_HEADER is the start of the activities.csv header of a Strava bulk
+// export, the summary columns followed by the details in SI units.
+const ARCHIVE_HEADER = "\ufeffActivity ID,Activity Date,Activity Name,Activity Type,Activity Description," +
+	"Elapsed Time,Distance,Max Heart Rate,Relative Effort,Commute,Activity Private Note,Activity Gear,Filename," +
+	"Athlete Weight,Bike Weight,Elapsed Time,Moving Time,Distance,Max Speed,Average Speed,Elevation Gain," +
+	"Elevation Loss,Elevation Low,Elevation High,Max Grade,Average Grade,Average Positive Grade," +
+	"Average Negative Grade,Max Cadence,Average Cadence,Max Heart Rate,Average Heart Rate,Max Watts," +
+	"Average Watts,Calories\n"
+
+func TestParseArchiveActivities(t *testing.T) {
+	tests := []struct {
+		name string
+		row  string
+		want Activity
+	}{
+		{
+			name: "distance in km then meters",
+			row: `123,"Jan 2, 2023, 7:14:33 AM",Morning Ride,Ride,"Easy, with friends",3723,25.43,165.0,42,false,,,` +
+				`activities/123.fit.gz,,,3723.0,3600.0,25430.0,12.5,7.06,210.0,205.0,12.0,110.0,8.5,0.0,,,,82.0,165.0,140.0,,180.0,650.0`,
+			want: Activity{
+				BaseActivity: BaseActivity{
+					Id: 123, Name: "Morning Ride", Description: "Easy, with friends",
+					Distance: 25430, Elevation: 210, ElapsedTime: 3723, MovingTime: 3600,
+					AvgSpeed: 7.06, MaxSpeed: 12.5, AvgWatts: 180, AvgCadence: 82,
+					AvgHeartrate: 140, MaxHeartrate: 165, Calories: 650, SufferScore: 42,
+				},
+				AthleteId: 42, SportType: "Ride", Type: "Ride", StartDate: "20230102T071433Z",
+			},
+		},
+		{
+			// The summary distance is in the athlete's units, it's no
+			// fallback for the meters.
+			name: "empty meters",
+			row:  "124,\"Mar 5, 2024, 6:02:00 PM\",Gym,Weight Training,,2700,0.00,,,true,,,,,,2700.0,2700.0,,,,,,,,,,,,,,,,,,",
+			want: Activity{
+				BaseActivity: BaseActivity{Id: 124, Name: "Gym", ElapsedTime: 2700, MovingTime: 2700, Commute: true},
+				AthleteId:    42, SportType: "WeightTraining", Type: "WeightTraining", StartDate: "20240305T180200Z",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			activities, rowErrors, err := parseArchiveActivities(strings.NewReader(ARCHIVE_HEADER+test.row+"\n"), 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rowErrors) != 0 {
+				t.Fatalf("unexpected row errors: %v", rowErrors)
+			}
+			if len(activities) != 1 {
+				t.Fatalf("got %d activities, want 1", len(activities))
+			}
+			if got := activities[0]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseArchiveActivitiesErrors(t *testing.T) {
+	archive := ARCHIVE_HEADER +
+		"abc,\"Jan 2, 2023, 7:14:33 AM\",Ride,Ride\n" +
+		"125,yesterday,Ride,Ride\n" +
+		"126,\"Jan 2, 2023, 7:14:33 AM\",Ride,\n"
+	activities, rowErrors, err := parseArchiveActivities(strings.NewReader(archive), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 0 {
+		t.Errorf("got %d activities, want none", len(activities))
+	}
+	want := []string{
+		`line 2: invalid activity id "abc"`,
+		`line 3: activity 125: invalid date "yesterday"`,
+		`line 4: activity 126: missing type`,
+	}
+	if strings.Join(rowErrors, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors %q, want %q", rowErrors, want)
+	}
+
+	if _, _, err := parseArchiveActivities(strings.NewReader("Name,Date\n"), 42); err == nil {
+		t.Error("expected an error without an Activity ID column")
+	}
+}
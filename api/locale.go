@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_LANGUAGE = "en"
+
+// locale is the message catalog of a language. Messages are keyed by their
+// English text, a missing translation falls back to English.
+type locale struct {
+	messages  map[string]string
+	typeNames map[string]string
+	decimal   string
+	months    [12]string
+	// dateFormat is a fmt format taking the day, month name and year.
+	dateFormat string
+}
+
+var locales = map[string]*locale{
+	"en": {
+		typeNames: activityTypeNames,
+		decimal:   ".",
+		months: [12]string{
+			"January", "February", "March", "April", "May", "June",
+			"July", "August", "September", "October", "November", "December",
+		},
+		dateFormat: "%[2]s %[1]d, %[3]d",
+	},
+	"fr": {
+		messages: map[string]string{
+			"Duration":        "Durée",
+			"Distance":        "Distance",
+			"Elevation":       "Dénivelé",
+			"Average Speed":   "Vitesse moyenne",
+			"Average Pace":    "Allure moyenne",
+			"Average Power":   "Puissance moyenne",
+			"Average Cadence": "Cadence moyenne",
+			"excluding %s":    "sauf %s",
+			"since %s":        "depuis le %s",
+			"until %s":        "jusqu'au %s",
+			"%s or more":      "%s ou plus",
+			"commutes only":   "trajets domicile-travail uniquement",
+			"no commutes":     "sans trajets domicile-travail",
+			"indoor only":     "home trainer uniquement",
+			"no indoor":       "sans home trainer",
+			"gear %s":         "équipement %s",
+			"Moving Time":     "Temps de déplacement",
+			"Heart Rate":      "Fréquence cardiaque",
+			"max":             "max",
+			"Calories":        "Calories",
+			"Relative Effort": "Effort relatif",
+			"Device":          "Appareil",
+			"Map":             "Carte",
+		},
+		typeNames: map[string]string{
+			"AlpineSki":                     "Ski alpin",
+			"BackcountrySki":                "Ski de randonnée",
+			"Badminton":                     "Badminton",
+			"Canoeing":                      "Canoë",
+			"Crossfit":                      "Crossfit",
+			"EBikeRide":                     "Vélo électrique",
+			"Elliptical":                    "Elliptique",
+			"EMountainBikeRide":             "VTT électrique",
+			"Golf":                          "Golf",
+			"GravelRide":                    "Gravel",
+			"Handcycle":                     "Handbike",
+			"HighIntensityIntervalTraining": "Fractionné haute intensité",
+			"Hike":                          "Randonnée",
+			"IceSkate":                      "Patin à glace",
+			"InlineSkate":                   "Roller",
+			"Kayaking":                      "Kayak",
+			"Kitesurf":                      "Kitesurf",
+			"MountainBikeRide":              "VTT",
+			"NordicSki":                     "Ski nordique",
+			"Pickleball":                    "Pickleball",
+			"Pilates":                       "Pilates",
+			"Racquetball":                   "Racquetball",
+			"Ride":                          "Vélo",
+			"RockClimbing":                  "Escalade",
+			"RollerSki":                     "Ski-roues",
+			"Rowing":                        "Aviron",
+			"Run":                           "Course à pied",
+			"Sail":                          "Voile",
+			"Skateboard":                    "Skateboard",
+			"Snowboard":                     "Snowboard",
+			"Snowshoe":                      "Raquettes",
+			"Soccer":                        "Football",
+			"Squash":                        "Squash",
+			"StairStepper":                  "Stepper",
+			"StandUpPaddling":               "Stand up paddle",
+			"Surfing":                       "Surf",
+			"Swim":                          "Natation",
+			"TableTennis":                   "Tennis de table",
+			"Tennis":                        "Tennis",
+			"TrailRun":                      "Trail",
+			"Velomobile":                    "Vélomobile",
+			"VirtualRide":                   "Vélo virtuel",
+			"VirtualRow":                    "Aviron virtuel",
+			"VirtualRun":                    "Course virtuelle",
+			"Walk":                          "Marche",
+			"WeightTraining":                "Musculation",
+			"Wheelchair":                    "Fauteuil roulant",
+			"Windsurf":                      "Planche à voile",
+			"Workout":                       "Entraînement",
+			"Yoga":                          "Yoga",
+		},
+		decimal: ",",
+		months: [12]string{
+			"janvier", "février", "mars", "avril", "mai", "juin",
+			"juillet", "août", "septembre", "octobre", "novembre", "décembre",
+		},
+		dateFormat: "%[1]d %[2]s %[3]d",
+	},
+	"de": {
+		messages: map[string]string{
+			"Duration":        "Dauer",
+			"Distance":        "Distanz",
+			"Elevation":       "Höhenmeter",
+			"Average Speed":   "Durchschnittsgeschwindigkeit",
+			"Average Pace":    "Durchschnittliches Tempo",
+			"Average Power":   "Durchschnittsleistung",
+			"Average Cadence": "Durchschnittliche Trittfrequenz",
+			"excluding %s":    "ohne %s",
+			"since %s":        "seit %s",
+			"until %s":        "bis %s",
+			"%s or more":      "%s oder mehr",
+			"commutes only":   "nur Pendelfahrten",
+			"no commutes":     "ohne Pendelfahrten",
+			"indoor only":     "nur Indoor",
+			"no indoor":       "ohne Indoor",
+			"gear %s":         "Ausrüstung %s",
+			"Moving Time":     "Bewegungszeit",
+			"Heart Rate":      "Herzfrequenz",
+			"max":             "max.",
+			"Calories":        "Kalorien",
+			"Relative Effort": "Relative Anstrengung",
+			"Device":          "Gerät",
+			"Map":             "Karte",
+		},
+		typeNames: map[string]string{
+			"AlpineSki":                     "Alpinski",
+			"BackcountrySki":                "Skitour",
+			"Badminton":                     "Badminton",
+			"Canoeing":                      "Kanufahren",
+			"Crossfit":                      "Crossfit",
+			"EBikeRide":                     "E-Bike-Fahrt",
+			"Elliptical":                    "Crosstrainer",
+			"EMountainBikeRide":             "E-Mountainbike-Fahrt",
+			"Golf":                          "Golf",
+			"GravelRide":                    "Gravel-Fahrt",
+			"Handcycle":                     "Handbike",
+			"HighIntensityIntervalTraining": "Hochintensives Intervalltraining",
+			"Hike":                          "Wanderung",
+			"IceSkate":                      "Eislaufen",
+			"InlineSkate":                   "Inlineskaten",
+			"Kayaking":                      "Kajakfahren",
+			"Kitesurf":                      "Kitesurfen",
+			"MountainBikeRide":              "Mountainbike-Fahrt",
+			"NordicSki":                     "Langlauf",
+			"Pickleball":                    "Pickleball",
+			"Pilates":                       "Pilates",
+			"Racquetball":                   "Racquetball",
+			"Ride":                          "Radfahrt",
+			"RockClimbing":                  "Klettern",
+			"RollerSki":                     "Skiroller",
+			"Rowing":                        "Rudern",
+			"Run":                           "Lauf",
+			"Sail":                          "Segeln",
+			"Skateboard":                    "Skateboarden",
+			"Snowboard":                     "Snowboarden",
+			"Snowshoe":                      "Schneeschuhwandern",
+			"Soccer":                        "Fußball",
+			"Squash":                        "Squash",
+			"StairStepper":                  "Treppensteiger",
+			"StandUpPaddling":               "Stand-Up-Paddling",
+			"Surfing":                       "Surfen",
+			"Swim":                          "Schwimmen",
+			"TableTennis":                   "Tischtennis",
+			"Tennis":                        "Tennis",
+			"TrailRun":                      "Traillauf",
+			"Velomobile":                    "Velomobil",
+			"VirtualRide":                   "Virtuelle Radfahrt",
+			"VirtualRow":                    "Virtuelles Rudern",
+			"VirtualRun":                    "Virtueller Lauf",
+			"Walk":                          "Spaziergang",
+			"WeightTraining":                "Krafttraining",
+			"Wheelchair":                    "Rollstuhl",
+			"Windsurf":                      "Windsurfen",
+			"Workout":                       "Training",
+			"Yoga":                          "Yoga",
+		},
+		decimal: ",",
+		months: [12]string{
+			"Januar", "Februar", "März", "April", "Mai", "Juni",
+			"Juli", "August", "September", "Oktober", "November", "Dezember",
+		},
+		dateFormat: "%[1]d. %[2]s %[3]d",
+	},
+}
+
+// supportedLanguages lists the locales keys in a stable order for messages.
+func supportedLanguages() []string {
+	languages := make([]string, 0, len(locales))
+	for language := range locales {
+		languages = append(languages, language)
+	}
+	slices.Sort(languages)
+	return languages
+}
+
+func getLocale(language string) *locale {
+	if loc, ok := locales[language]; ok {
+		return loc
+	}
+	return locales[DEFAULT_LANGUAGE]
+}
+
+// text translates an English message.
+func (l *locale) text(message string) string {
+	if translated, ok := l.messages[message]; ok {
+		return translated
+	}
+	return message
+}
+
+// textf translates an English format and formats it.
+func (l *locale) textf(format string, args ...any) string {
+	return fmt.Sprintf(l.text(format), args...)
+}
+
+// typeName returns the display name of a Strava sport type.
+func (l *locale) typeName(activityType string) string {
+	if name, ok := l.typeNames[activityType]; ok {
+		return name
+	}
+	return activityType
+}
+
+func (l *locale) typeNameList(activityTypes []string) string {
+	names := make([]string, len(activityTypes))
+	for i, activityType := range activityTypes {
+		names[i] = l.typeName(activityType)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (l *locale) number(value float64, decimals int) string {
+	return strings.Replace(strconv.FormatFloat(value, 'f', decimals, 64), ".", l.decimal, 1)
+}
+
+func (l *locale) date(t time.Time) string {
+	return fmt.Sprintf(l.dateFormat, t.Day(), l.months[t.Month()-1], t.Year())
+}
+
+// acceptLanguage picks the preferred supported language of an
+// Accept-Language header, e.g. "fr-CH, fr;q=0.9, en;q=0.8", or "" if none is
+// supported.
+func acceptLanguage(header string) string {
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		language, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if _, ok := locales[language]; ok && quality > bestQuality {
+			best, bestQuality = language, quality
+		}
+	}
+	return best
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+
+	"strava2cal/geocode"
+)
+
+const (
+	HOME_PRIVACY_SUPPRESS = "suppress"
+	HOME_PRIVACY_ROUND    = "round"
+	// DEFAULT_HOME_RADIUS is in meters.
+	DEFAULT_HOME_RADIUS = 1000
+	// ROUNDED_DECIMALS keeps coordinates to about a kilometer.
+	ROUNDED_DECIMALS = 2
+	ROUNDED_RADIUS   = 1000
+	// LOCATION_MAX_DISTANCE is how far in meters the nearest city may be for
+	// the event location to be named after it.
+	LOCATION_MAX_DISTANCE = 30000
+)
+
+var geocoder *geocode.Geocoder
+
+// initGeocoder loads the GeoNames dump at GEONAMES_PATH, or the bundled
+// cities when unset.
+func initGeocoder() error {
+	if GEONAMES_PATH == "" {
+		var err error
+		geocoder, err = geocode.Default()
+		return err
+	}
+
+	file, err := os.Open(GEONAMES_PATH)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	places, err := geocode.Load(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", GEONAMES_PATH, err)
+	}
+	slog.Info("GeoNames places loaded", "path", GEONAMES_PATH, "count", len(places))
+	geocoder = geocode.New(places)
+	return nil
+}
+
+// HomeSettings protects the athlete's home: the events of activities
+// starting or ending within Radius meters of it get their position rounded
+// (HOME_PRIVACY_ROUND) or left out (HOME_PRIVACY_SUPPRESS, the default).
+type HomeSettings struct {
+	Lat     float64 `json:"lat" bson:"lat"`
+	Lng     float64 `json:"lng" bson:"lng"`
+	Radius  float64 `json:"radius,omitempty" bson:"radius,omitempty"`
+	Privacy string  `json:"privacy,omitempty" bson:"privacy,omitempty"`
+}
+
+func (h *HomeSettings) Validate() error {
+	if h.Lat < -90 || h.Lat > 90 || h.Lng < -180 || h.Lng > 180 {
+		return fmt.Errorf("invalid home coordinates %g, %g", h.Lat, h.Lng)
+	}
+	if h.Radius < 0 {
+		return fmt.Errorf("invalid home radius %g, expected meters", h.Radius)
+	}
+	switch h.Privacy {
+	case "", HOME_PRIVACY_SUPPRESS, HOME_PRIVACY_ROUND:
+		return nil
+	}
+	return fmt.Errorf("invalid home privacy %q, expected %s or %s", h.Privacy, HOME_PRIVACY_SUPPRESS, HOME_PRIVACY_ROUND)
+}
+
+func (h *HomeSettings) radius() float64 {
+	if h.Radius == 0 {
+		return DEFAULT_HOME_RADIUS
+	}
+	return h.Radius
+}
+
+func (h *HomeSettings) privacy() string {
+	if h.Privacy == "" {
+		return HOME_PRIVACY_SUPPRESS
+	}
+	return h.Privacy
+}
+
+func (h *HomeSettings) isNear(latlng []float64) bool {
+	return len(latlng) == 2 && geocode.Distance(h.Lat, h.Lng, latlng[0], latlng[1]) <= h.radius()
+}
+
+// eventPlace is where an activity event takes place.
+type eventPlace struct {
+	Lat, Lng float64
+	// Name is the nearest city, empty when there is none close enough.
+	Name string
+	// Rounded tells the coordinates were rounded around the home.
+	Rounded bool
+}
+
+// eventPlace locates the activity by its start. Returns nil for activities
+// without coordinates, or whose coordinates the privacy policies removed.
+func (a *feedActivity) eventPlace() *eventPlace {
+	if len(a.StartLatlng) != 2 {
+		return nil
+	}
+	place := &eventPlace{Lat: a.StartLatlng[0], Lng: a.StartLatlng[1], Rounded: a.Rounded}
+	if geocoder != nil {
+		if city, ok := geocoder.Nearest(place.Lat, place.Lng, LOCATION_MAX_DISTANCE); ok {
+			place.Name = city.String()
+		}
+	}
+	return place
+}
+
+// roundLatlng rounds the coordinates to about a kilometer, see
+// ROUNDED_DECIMALS.
+func roundLatlng(latlng []float64) []float64 {
+	if len(latlng) != 2 {
+		return nil
+	}
+	return []float64{roundCoordinate(latlng[0]), roundCoordinate(latlng[1])}
+}
+
+func roundCoordinate(degrees float64) float64 {
+	factor := math.Pow(10, ROUNDED_DECIMALS)
+	return math.Round(degrees*factor) / factor
+}
@@ -7,8 +7,6 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"strings"
-	"time"
 )
 
 var (
@@ -17,9 +15,24 @@ var (
 	APP_ADDRESS   = os.Getenv("APP_ADDRESS")
 	MONGO_URI     = os.Getenv("MONGO_URI")
 	MONGO_DB      = os.Getenv("MONGO_DB")
+	STORE         = os.Getenv("STORE")
+	SQLITE_PATH   = os.Getenv("SQLITE_PATH")
+
+	STRAVA_BASE_URL = os.Getenv("STRAVA_BASE_URL")
+	STRAVA_PROXY    = os.Getenv("STRAVA_PROXY")
+
+	ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+
+	GEONAMES_PATH = os.Getenv("GEONAMES_PATH")
+	SIGNING_KEY   = os.Getenv("SIGNING_KEY")
 )
 
-const VERIFY_TOKEN = "strava2cal_verify_token"
+const (
+	VERIFY_TOKEN    = "strava2cal_verify_token"
+	WEBHOOK_WORKERS = 2
+	// MAX_WEBHOOK_BODY is far above the size of a Strava event.
+	MAX_WEBHOOK_BODY = 16 << 10
+)
 
 type WebhookData struct {
 	AspectType     string `json:"aspect_type"`
@@ -28,6 +41,29 @@ type WebhookData struct {
 	ObjectType     string `json:"object_type"`
 	OwnerId        int    `json:"owner_id"`
 	SubscriptionId int    `json:"subscription_id"`
+	// Updates holds the changed fields of update events, e.g. "title" for an
+	// activity or "authorized" when an athlete revokes access.
+	Updates WebhookUpdates `json:"updates"`
+}
+
+// WebhookUpdates are documented as strings ("true", "false") but any scalar is
+// accepted and stored in its string form.
+type WebhookUpdates map[string]string
+
+func (u *WebhookUpdates) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*u = make(WebhookUpdates, len(raw))
+	for key, value := range raw {
+		if s, ok := value.(string); ok {
+			(*u)[key] = s
+		} else {
+			(*u)[key] = fmt.Sprint(value)
+		}
+	}
+	return nil
 }
 
 func initLogger() {
@@ -56,7 +92,7 @@ func initLogger() {
 }
 func handleHook(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_WEBHOOK_BODY))
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
@@ -71,40 +107,45 @@ func handleHook(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if webhookData.ObjectType != "activity" {
+		if webhookData.ObjectType != "activity" && webhookData.ObjectType != "athlete" {
 			return
 		}
-		token, err := RefreshTokenIfExpired()
 
-		if webhookData.AspectType == "delete" {
-			slog.Info("Activity deleted webhook received", "activity_id", webhookData.ObjectId)
-			err := removeActivity(webhookData.ObjectId)
-			if err != nil {
-				slog.Error("Failed to remove activity", "error", err, "activity_id", webhookData.ObjectId)
-			}
+		// Anyone can post to /hook, only events of the application's
+		// subscription are trusted.
+		subscriptionId, err := store.GetSubscription()
+		if err != nil {
+			http.Error(w, "Failed to load subscription id", http.StatusInternalServerError)
 			return
 		}
-		slog.Info("Creating/updating activity webhook received", "activity_id", webhookData.ObjectId)
-
-		if err != nil || token == nil {
-			http.Error(w, "Failed to load/refresh token", http.StatusInternalServerError)
+		if subscriptionId == 0 || webhookData.SubscriptionId != subscriptionId {
+			slog.Warn("Webhook event of an unknown subscription rejected", "subscription_id", webhookData.SubscriptionId)
+			http.Error(w, "Unknown subscription", http.StatusForbidden)
 			return
 		}
 
-		activity, err := FetchActivity(token.AccessToken, webhookData.ObjectId)
+		token, err := store.GetToken(webhookData.OwnerId)
 		if err != nil {
-			slog.Error("Failed to fetch activity", "error", err, "activity_id", webhookData.ObjectId)
-			http.Error(w, "Failed to fetch activity", http.StatusInternalServerError)
+			http.Error(w, "Failed to load token", http.StatusInternalServerError)
 			return
 		}
-		err = upsertActivity(activity)
-		if err != nil {
-			http.Error(w, "Failed to save activity", http.StatusInternalServerError)
+		if token == nil {
+			slog.Debug("Webhook event of an unknown athlete ignored", "athlete_id", webhookData.OwnerId)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"event ignored"}`))
 			return
 		}
 
+		event := newWebhookEvent(webhookData)
+		if err := store.SaveEvent(event); err != nil {
+			slog.Error("Failed to queue webhook event", "error", err, "activity_id", webhookData.ObjectId)
+			http.Error(w, "Failed to queue webhook event", http.StatusInternalServerError)
+			return
+		}
+		slog.Debug("Webhook event queued", "event_id", event.Id, "aspect_type", webhookData.AspectType, "activity_id", webhookData.ObjectId)
+
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"event added"}`))
+		w.Write([]byte(`{"status":"event queued"}`))
 	}
 	if r.Method == http.MethodGet {
 		slog.Info("Webhook verification request received")
@@ -139,105 +180,108 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing code parameter", http.StatusBadRequest)
 		return
 	}
-	token, err := ExchangeCode(code)
+	token, err := strava.ExchangeCode(code)
 	if err != nil {
 		http.Error(w, "Failed to exchange code for token", http.StatusInternalServerError)
 		return
 	}
 
-	err = saveToken(token)
+	err = store.SaveToken(token)
 	if err != nil {
 		http.Error(w, "Failed to save token", http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusFound)
-}
+	feedToken, err := ensureFeedToken(token.AthleteId)
+	if err != nil {
+		http.Error(w, "Failed to create calendar feed token", http.StatusInternalServerError)
+		return
+	}
 
-func escapeICalText(s string) string {
-	s = strings.ReplaceAll(s, `\`, `\\`)
-	s = strings.ReplaceAll(s, ";", `\;`)
-	s = strings.ReplaceAll(s, ",", `\,`)
-	s = strings.ReplaceAll(s, "\n", `\n`)
-	return s
+	// Going through the Strava authorization proves the athlete owns the
+	// account, each time mints a new management token. It is passed in the
+	// fragment, which browsers don't send to servers.
+	managementToken, err := newManagementToken(token.AthleteId)
+	if err != nil {
+		http.Error(w, "Failed to create management token", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Athlete authorized", "athlete_id", token.AthleteId)
+	http.Redirect(w, r, fmt.Sprintf("/?athlete=%d&feed=%s#token=%s", token.AthleteId, feedToken, managementToken), http.StatusFound)
 }
 
 func main() {
 	initLogger()
 
 	slog.Info("Strava To Calendar is starting")
-	if err := initMongo(); err != nil {
-		slog.Error("Failed to initialize MongoDB", "error", err)
-	} else {
-		slog.Info("MongoDB initialized successfully")
-		defer disconnectMongo()
+	if err := initStore(); err != nil {
+		slog.Error("Failed to initialize store", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Store initialized successfully")
+	defer store.Close()
+
+	if migrated, err := store.MigrateActivityTypes(); err != nil {
+		slog.Error("Failed to migrate activity types", "error", err)
+		os.Exit(1)
+	} else if migrated > 0 {
+		slog.Info("Activity types migrated", "count", migrated)
 	}
-	http.HandleFunc("/auth", handleAuth)
-	http.HandleFunc("/calendar", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
-		w.Header().Set("Content-Disposition", "attachment; filename=\"strava.ics\"")
 
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil {
+			slog.Error("Failed to import archive", "error", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		token, err := getToken()
-		if err != nil || token == nil {
-			http.Error(w, "Failed to load token", http.StatusInternalServerError)
-			return
-		}
-		activities, err := getActivities()
-		if err != nil {
-			http.Error(w, "Failed to load activities", http.StatusInternalServerError)
-			return
-		}
+	if err := initStravaClient(); err != nil {
+		slog.Error("Failed to initialize Strava client", "error", err)
+		os.Exit(1)
+	}
 
-		icalData := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Strava To Calendar//EN\r\n"
+	if migrated, err := store.MigrateLegacyToken(legacyTokenAthlete); err != nil {
+		slog.Error("Failed to migrate the token stored before tokens were keyed by athlete, its athlete's activities won't be served until it is", "error", err)
+	} else if migrated > 0 {
+		slog.Info("Legacy token and activities migrated", "count", migrated)
+	}
 
-		nowUTC := time.Now().UTC().Format("20060102T150405Z")
+	if err := syncSubscription(); err != nil {
+		slog.Warn("Failed to look up the webhook subscription", "error", err)
+	}
 
-		for _, activity := range activities {
-			var descriptionParts []string
-			descriptionParts = append(descriptionParts, fmt.Sprintf("Duration: %s", (time.Duration(activity.ElapsedTime)*time.Second).String()))
-			descriptionParts = append(descriptionParts, fmt.Sprintf("Distance: %.2fkm | Elevation: %.0fm", activity.Distance/1000, activity.Elevation))
-			if activity.AvgSpeed > 0 {
-				descriptionParts = append(descriptionParts, fmt.Sprintf("Average Speed: %.2fkm/h", activity.AvgSpeed*3.6))
-			}
-			if activity.AvgWatts > 0 {
-				descriptionParts = append(descriptionParts, fmt.Sprintf("Average Power: %.0fW", activity.AvgWatts))
-			}
-			if activity.AvgCadence > 0 {
-				descriptionParts = append(descriptionParts, fmt.Sprintf("Average Cadence: %.0frpm", activity.AvgCadence))
-			}
-			descriptionParts = append(descriptionParts, fmt.Sprintf("strava.com/activities/%d", activity.Id))
-			description := escapeICalText(strings.Join(descriptionParts, "\n"))
-
-			summary := escapeICalText(fmt.Sprintf("%s | %s", activity.Type, activity.Name))
-
-			icalData += "BEGIN:VEVENT\r\n"
-			icalData += fmt.Sprintf("UID:%d@strava2cal\r\n", activity.Id)
-			icalData += fmt.Sprintf("DTSTAMP:%s\r\n", nowUTC)
-			icalData += fmt.Sprintf("SUMMARY:%s\r\n", summary)
-			icalData += fmt.Sprintf("DTSTART:%s\r\n", activity.StartDate)
-			icalData += fmt.Sprintf("DTEND:%s\r\n", activity.EndDate)
-			icalData += fmt.Sprintf("DESCRIPTION:%s\r\n", description)
-			icalData += "END:VEVENT\r\n"
-		}
+	if err := initGeocoder(); err != nil {
+		slog.Error("Failed to initialize geocoder", "error", err)
+		os.Exit(1)
+	}
 
-		icalData += "END:VCALENDAR\r\n"
+	startWebhookWorkers(WEBHOOK_WORKERS)
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(icalData))
-	})
+	http.HandleFunc("/auth", handleAuth)
+	http.HandleFunc("GET /calendar/{file}", handleCalendar)
+	http.HandleFunc("POST /calendar/{token}/rotate", handleRotateFeedToken)
+	http.HandleFunc("OPTIONS /calendar/{token}/rotate", handlePreflight)
+	http.HandleFunc("DELETE /calendar/{token}", handleRevokeFeedToken)
+	http.HandleFunc("GET /calendar/{token}/settings", handleGetFeedSettings)
+	http.HandleFunc("PUT /calendar/{token}/settings", handleSaveFeedSettings)
+	http.HandleFunc("GET /feeds", handleListFeeds)
+	http.HandleFunc("POST /feeds", handleCreateFeed)
+	http.HandleFunc("POST /feeds/preview", handlePreviewTemplates)
+	http.HandleFunc("OPTIONS /feeds/preview", handlePreflight)
+	http.HandleFunc("GET /feeds/{id}", handleGetFeed)
+	http.HandleFunc("PUT /feeds/{id}", handleUpdateFeed)
+	http.HandleFunc("DELETE /feeds/{id}", handleDeleteFeed)
+	http.HandleFunc("GET /activities/{id}/map.png", handleActivityMap)
+	http.HandleFunc("GET /activities/{file}", handleActivityGPX)
+	http.HandleFunc("GET /activities.geojson", handleActivitiesGeoJSON)
+	http.HandleFunc("GET /export/activities.csv", handleExportCSV)
+	http.HandleFunc("GET /export/activities.json", handleExportJSON)
+	http.HandleFunc("POST /activities/import", handleImportArchive)
 	http.HandleFunc("/hook", handleHook)
 	http.HandleFunc("/auth/start", func(w http.ResponseWriter, r *http.Request) {
-		redirectURL := fmt.Sprintf(
-			"https://www.strava.com/oauth/authorize?client_id=%s&response_type=code&redirect_uri=%s/auth&scope=activity:read_all",
-			CLIENT_ID,
-			APP_ADDRESS,
-		)
-		http.Redirect(w, r, redirectURL, http.StatusFound)
+		http.Redirect(w, r, strava.AuthorizeURL(APP_ADDRESS+"/auth"), http.StatusFound)
 	})
 
 	http.HandleFunc("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
@@ -247,59 +291,43 @@ func main() {
 		w.Header().Set("Content-Type", "application/json")
 		switch r.Method {
 		case http.MethodPost:
-			err := registerWebhook(APP_ADDRESS+"/hook", VERIFY_TOKEN)
+			subId, err := strava.RegisterWebhook(APP_ADDRESS+"/hook", VERIFY_TOKEN)
 			if err != nil {
 				slog.Error("Failed to register webhook", "error", err)
 				http.Error(w, "Failed to register webhook", http.StatusInternalServerError)
 				return
 			}
+			if err := store.SaveSubscription(subId); err != nil {
+				slog.Error("Failed to save subscription id", "error", err, "subscription_id", subId)
+			}
 			w.WriteHeader(http.StatusCreated)
 			w.Write([]byte(`{"status":"webhook registered"}`))
 		case http.MethodDelete:
-			subId, err := getWebhook()
+			subId, err := store.GetSubscription()
+			if err == nil && subId == 0 {
+				subId, err = strava.GetWebhook()
+			}
 			if err != nil {
 				http.Error(w, "Failed to load subscription id", http.StatusInternalServerError)
 				return
 			}
 			slog.Info("Unregistering webhook", "subscription_id", subId)
-			err = unregisterWebhook(subId)
+			err = strava.UnregisterWebhook(subId)
 			if err != nil {
 				http.Error(w, "Failed to unregister webhook", http.StatusInternalServerError)
 				return
 			}
+			if err := store.RemoveSubscription(); err != nil {
+				slog.Error("Failed to remove subscription id", "error", err)
+			}
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"status":"webhook unregistered"}`))
 		}
 	})
-	http.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		slog.Info("Starting to fetch past activities")
-		token, err := RefreshTokenIfExpired()
-		if err != nil {
-			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
-			return
-		}
-
-		activities, err := FetchAthleteActivities(token.AccessToken)
-		if err != nil {
-			http.Error(w, "Failed to fetch activities", http.StatusInternalServerError)
-			return
-		}
-		slog.Info("Successfully fetched past activities", "count", len(activities))
-		if len(activities) > 0 {
-			if err := setActivities(activities); err != nil {
-				http.Error(w, "Failed to save activities", http.StatusInternalServerError)
-				return
-			}
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"activities fetched"}`))
-	})
+	http.HandleFunc("/fetch", handleFetch)
+	http.HandleFunc("GET /ratelimit", handleRateLimit)
+	http.HandleFunc("GET /admin/events/dead", handleListDeadEvents)
+	http.HandleFunc("POST /admin/events/{id}/replay", handleReplayEvent)
 
 	http.ListenAndServe(":8080", nil)
 
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"strava2cal/route"
+)
+
+const (
+	MAP_WIDTH   = 480
+	MAP_HEIGHT  = 320
+	MAP_PADDING = 16
+)
+
+// signingKey authenticates the map URLs, which calendar apps fetch without
+// credentials. SIGNING_KEY defaults to a key derived from the client secret.
+func signingKey() []byte {
+	if SIGNING_KEY != "" {
+		return []byte(SIGNING_KEY)
+	}
+	key := sha256.Sum256([]byte("strava2cal signing key:" + CLIENT_SECRET))
+	return key[:]
+}
+
+// MAP_URL_LIFETIME is how long a map URL stays valid at least. Feeds are
+// fetched again long before, and the expiry is rounded to the day so that
+// the URL, and the calendar event, doesn't change on every fetch.
+const MAP_URL_LIFETIME = 7 * 24 * time.Hour
+
+// signMap signs the map of the activity as shown in the feed, feedId being
+// empty for the athlete's main calendar feed.
+func signMap(athleteId, activityId int, feedId string, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey())
+	fmt.Fprintf(mac, "map:%d:%d:%s:%d", athleteId, activityId, feedId, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mapUrl is the signed URL of the activity route sketch, empty when it has no
+// route. The activity must have gone through FeedSettings.feedActivity, which
+// removes the routes that must not be shown.
+func (f *Feed) mapUrl(activity *Activity) string {
+	if activity.Map.SummaryPolyline == "" {
+		return ""
+	}
+	expires := startOfDay(time.Now()).Add(MAP_URL_LIFETIME + 24*time.Hour).Unix()
+	q := url.Values{}
+	q.Set("athlete", strconv.Itoa(activity.AthleteId))
+	if f.Id != "" {
+		q.Set("feed", f.Id)
+	}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", signMap(activity.AthleteId, activity.Id, f.Id, expires))
+	return fmt.Sprintf("%s/activities/%d/map.png?%s", APP_ADDRESS, activity.Id, q.Encode())
+}
+
+// mapFeedSettings returns the settings of the feed the map URL was made for,
+// nil when the feed is gone.
+func mapFeedSettings(athleteId int, feedId string) (*FeedSettings, error) {
+	if feedId == "" {
+		token, err := store.GetToken(athleteId)
+		if err != nil || token == nil || token.FeedToken == "" {
+			return nil, err
+		}
+		settings := token.feedSettings()
+		return &settings, nil
+	}
+	feed, err := store.GetFeed(feedId)
+	if err != nil || feed == nil || feed.AthleteId != athleteId {
+		return nil, err
+	}
+	return &feed.Settings, nil
+}
+
+// handleActivityMap serves the route sketch of a signed map URL. The privacy
+// policies of the feed are checked again since the activity or the feed may
+// have changed after the URL was handed out.
+func handleActivityMap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	activityId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	athleteId, err := strconv.Atoi(query.Get("athlete"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	feedId := query.Get("feed")
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(signMap(athleteId, activityId, feedId, expires))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Map link expired", http.StatusGone)
+		return
+	}
+
+	settings, err := mapFeedSettings(athleteId, feedId)
+	if err != nil {
+		http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+		return
+	}
+	if settings == nil {
+		http.NotFound(w, r)
+		return
+	}
+	activity, err := store.GetActivity(athleteId, activityId)
+	if err != nil {
+		http.Error(w, "Failed to load activity", http.StatusInternalServerError)
+		return
+	}
+	if activity == nil {
+		http.NotFound(w, r)
+		return
+	}
+	shown := settings.feedActivity(activity)
+	if shown == nil || shown.Map.SummaryPolyline == "" {
+		http.NotFound(w, r)
+		return
+	}
+	points, err := route.DecodePolyline(shown.Map.SummaryPolyline)
+	if err != nil {
+		slog.Error("Failed to decode activity polyline", "error", err, "activity_id", activityId)
+		http.Error(w, "Failed to decode route", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	// Short enough for a privacy change to apply soon to cached copies.
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	if err := route.EncodePNG(w, points, MAP_WIDTH, MAP_HEIGHT, MAP_PADDING); err != nil {
+		slog.Error("Failed to write activity map", "error", err, "activity_id", activityId)
+	}
+}
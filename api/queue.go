@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	MAX_EVENT_ATTEMPTS = 8
+	// EVENT_REQUESTS is the most Strava calls processing an event makes, a
+	// token refresh and a fetch.
+	EVENT_REQUESTS = 2
+	// EVENT_LEASE is how long a claimed event is hidden from other workers,
+	// longer than processing it can take so that no two workers process it at
+	// once. An event whose worker died is picked up again once the lease
+	// expires.
+	EVENT_LEASE          = EVENT_REQUESTS*MAX_REQUEST_TIME + 5*time.Minute
+	EVENT_POLL_INTERVAL  = time.Second
+	EVENT_RETRY_DELAY    = 30 * time.Second
+	EVENT_MAX_RETRY_WAIT = time.Hour
+)
+
+// WebhookEvent is a webhook notification waiting to be processed. Events that
+// failed MAX_EVENT_ATTEMPTS times are kept as dead letters until replayed.
+type WebhookEvent struct {
+	Id        string      `json:"id" bson:"_id"`
+	Data      WebhookData `json:"data" bson:"data"`
+	Attempts  int         `json:"attempts" bson:"attempts"`
+	NextRunAt time.Time   `json:"next_run_at" bson:"next_run_at"`
+	LastError string      `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	Dead      bool        `json:"dead" bson:"dead"`
+	CreatedAt time.Time   `json:"created_at" bson:"created_at"`
+}
+
+func newWebhookEvent(data WebhookData) *WebhookEvent {
+	now := time.Now().UTC()
+	return &WebhookEvent{
+		Id:        rand.Text(),
+		Data:      data,
+		NextRunAt: now,
+		CreatedAt: now,
+	}
+}
+
+// permanentError marks a failure that retrying won't fix, the event goes
+// straight to the dead letters.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func startWebhookWorkers(count int) {
+	for i := 0; i < count; i++ {
+		go runWebhookWorker()
+	}
+	slog.Info("Webhook workers started", "count", count)
+}
+
+func runWebhookWorker() {
+	for {
+		event, err := store.ClaimEvent(time.Now().UTC(), EVENT_LEASE)
+		if err != nil {
+			slog.Error("Failed to claim webhook event", "error", err)
+			time.Sleep(EVENT_POLL_INTERVAL)
+			continue
+		}
+		if event == nil {
+			time.Sleep(EVENT_POLL_INTERVAL)
+			continue
+		}
+		handleWebhookEvent(event)
+	}
+}
+
+func handleWebhookEvent(event *WebhookEvent) {
+	err := processWebhookEvent(event.Data)
+	if err == nil {
+		if err := store.DeleteEvent(event.Id); err != nil {
+			slog.Error("Failed to delete processed webhook event", "error", err, "event_id", event.Id)
+		}
+		return
+	}
+
+	event.LastError = err.Error()
+	var permanent permanentError
+	if errors.As(err, &permanent) || event.Attempts >= MAX_EVENT_ATTEMPTS {
+		event.Dead = true
+		slog.Error("Webhook event moved to dead letters", "error", err, "event_id", event.Id, "attempts", event.Attempts)
+	} else {
+		event.NextRunAt = time.Now().UTC().Add(eventRetryDelay(event.Attempts))
+		slog.Warn("Webhook event failed, will retry", "error", err, "event_id", event.Id, "attempts", event.Attempts, "next_run_at", event.NextRunAt)
+	}
+	if err := store.SaveEvent(event); err != nil {
+		slog.Error("Failed to save webhook event", "error", err, "event_id", event.Id)
+	}
+}
+
+// eventRetryDelay doubles with each attempt and is jittered so events that
+// failed together don't retry together.
+func eventRetryDelay(attempts int) time.Duration {
+	delay := EVENT_RETRY_DELAY << (attempts - 1)
+	if delay > EVENT_MAX_RETRY_WAIT || delay <= 0 {
+		delay = EVENT_MAX_RETRY_WAIT
+	}
+	return delay/2 + mathrand.N(delay/2)
+}
+
+func processWebhookEvent(data WebhookData) error {
+	if data.ObjectType == "athlete" {
+		if data.AspectType == "update" && data.Updates["authorized"] == "false" {
+			return deauthorizeAthlete(data.OwnerId)
+		}
+		return nil
+	}
+
+	if data.AspectType == "delete" {
+		slog.Info("Activity deleted webhook received", "athlete_id", data.OwnerId, "activity_id", data.ObjectId)
+		return store.RemoveActivity(data.OwnerId, data.ObjectId)
+	}
+	slog.Info("Creating/updating activity webhook received", "athlete_id", data.OwnerId, "activity_id", data.ObjectId)
+
+	// The updates are trusted without asking Strava only for events of the
+	// current subscription, handleHook rejects the others but the subscription
+	// may have changed since the event was queued.
+	subscriptionId, err := store.GetSubscription()
+	if err != nil {
+		return fmt.Errorf("failed to load subscription id: %w", err)
+	}
+	if data.AspectType == "update" && data.SubscriptionId == subscriptionId {
+		activity, err := store.GetActivity(data.OwnerId, data.ObjectId)
+		if err != nil {
+			return fmt.Errorf("failed to load activity: %w", err)
+		}
+		if activity != nil && activity.applyUpdates(data.Updates) {
+			slog.Debug("Applied activity updates without fetching", "activity_id", data.ObjectId, "updates", data.Updates)
+			if err := store.UpsertActivity(activity); err != nil {
+				return fmt.Errorf("failed to save activity: %w", err)
+			}
+			return nil
+		}
+	}
+
+	token, err := RefreshTokenIfExpired(data.OwnerId)
+	if err != nil {
+		return fmt.Errorf("failed to load/refresh token: %w", err)
+	}
+	if token == nil {
+		return permanentError{fmt.Errorf("no token stored for athlete %d", data.OwnerId)}
+	}
+
+	activity, err := strava.FetchActivity(token.AccessToken, data.ObjectId)
+	if err != nil {
+		return fmt.Errorf("failed to fetch activity: %w", err)
+	}
+	activity.AthleteId = data.OwnerId
+	if err := store.UpsertActivity(activity); err != nil {
+		return fmt.Errorf("failed to save activity: %w", err)
+	}
+	return nil
+}
+
+// requireAdmin checks the ADMIN_TOKEN bearer token, admin endpoints are
+// disabled when no token is configured.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	expected := "Bearer " + ADMIN_TOKEN
+	if ADMIN_TOKEN == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func handleListDeadEvents(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	events, err := store.ListDeadEvents()
+	if err != nil {
+		http.Error(w, "Failed to load dead letters", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []WebhookEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
+
+func handleReplayEvent(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	event, err := store.GetEvent(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Failed to load event", http.StatusInternalServerError)
+		return
+	}
+	if event == nil || !event.Dead {
+		http.NotFound(w, r)
+		return
+	}
+
+	event.Dead = false
+	event.Attempts = 0
+	event.NextRunAt = time.Now().UTC()
+	if err := store.SaveEvent(event); err != nil {
+		http.Error(w, "Failed to save event", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Dead webhook event replayed", "event_id", event.Id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"event replayed"}`))
+}
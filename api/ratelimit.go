@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_WINDOW = 15 * time.Minute
+	// RATE_LIMIT_HEADROOM is the share of each window kept free so webhook
+	// fetches still go through while a backfill is running.
+	RATE_LIMIT_HEADROOM = 0.05
+	// MAX_RATE_LIMIT_WAIT bounds how long a request is held back, past that
+	// the call fails instead of blocking (e.g. when the daily quota is spent).
+	MAX_RATE_LIMIT_WAIT = RATE_LIMIT_WINDOW + time.Minute
+
+	MAX_REQUEST_ATTEMPTS = 5
+	RETRY_BASE_DELAY     = time.Second
+	RETRY_MAX_DELAY      = time.Minute
+	// MAX_REQUEST_TIME bounds StravaClient.do: every attempt may wait for the
+	// rate limit, time out and back off.
+	MAX_REQUEST_TIME = MAX_REQUEST_ATTEMPTS * (MAX_RATE_LIMIT_WAIT + STRAVA_REQUEST_TIMEOUT + RETRY_MAX_DELAY)
+)
+
+// RateLimitUsage is the last quota state reported by Strava. The short window
+// resets every quarter hour and the daily one at midnight UTC.
+type RateLimitUsage struct {
+	ShortLimit int       `json:"short_limit"`
+	ShortUsage int       `json:"short_usage"`
+	DailyLimit int       `json:"daily_limit"`
+	DailyUsage int       `json:"daily_usage"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type rateLimiter struct {
+	mu    sync.Mutex
+	usage RateLimitUsage
+	// throttledUntil holds every request back after a 429, until the window
+	// that was exceeded resets.
+	throttledUntil time.Time
+}
+
+// current returns the usage with the windows that elapsed since the last
+// response reset to zero.
+func (l *rateLimiter) current(now time.Time) RateLimitUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	usage := l.usage
+	if !now.Truncate(RATE_LIMIT_WINDOW).Equal(usage.UpdatedAt.Truncate(RATE_LIMIT_WINDOW)) {
+		usage.ShortUsage = 0
+	}
+	if !startOfDay(now).Equal(startOfDay(usage.UpdatedAt)) {
+		usage.DailyUsage = 0
+	}
+	return usage
+}
+
+// update records the X-RateLimit-Limit and X-RateLimit-Usage headers, both
+// formatted as "<15 minutes>,<daily>".
+func (l *rateLimiter) update(header http.Header) {
+	shortLimit, dailyLimit, ok := parseRateLimitHeader(header.Get("X-RateLimit-Limit"))
+	if !ok {
+		return
+	}
+	shortUsage, dailyUsage, ok := parseRateLimitHeader(header.Get("X-RateLimit-Usage"))
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usage = RateLimitUsage{
+		ShortLimit: shortLimit,
+		ShortUsage: shortUsage,
+		DailyLimit: dailyLimit,
+		DailyUsage: dailyUsage,
+		UpdatedAt:  time.Now().UTC(),
+	}
+}
+
+// delay returns how long to hold the next request back, 0 when there's room
+// left in both windows.
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	l.mu.Lock()
+	throttled := l.throttledUntil.Sub(now)
+	l.mu.Unlock()
+	if throttled > 0 {
+		return throttled
+	}
+	usage := l.current(now)
+	if nearLimit(usage.DailyUsage, usage.DailyLimit) {
+		return startOfDay(now).Add(24 * time.Hour).Sub(now)
+	}
+	if nearLimit(usage.ShortUsage, usage.ShortLimit) {
+		return now.Truncate(RATE_LIMIT_WINDOW).Add(RATE_LIMIT_WINDOW).Sub(now)
+	}
+	return 0
+}
+
+// throttle records a 429 response: nothing is sent until the next quarter
+// hour, or until midnight UTC when the daily quota is the one spent.
+func (l *rateLimiter) throttle(now time.Time) {
+	until := now.Truncate(RATE_LIMIT_WINDOW).Add(RATE_LIMIT_WINDOW)
+	if usage := l.current(now); usage.DailyLimit > 0 && usage.DailyUsage >= usage.DailyLimit {
+		until = startOfDay(now).Add(24 * time.Hour)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.throttledUntil) {
+		l.throttledUntil = until
+	}
+}
+
+// wait blocks until the quota allows another request.
+func (l *rateLimiter) wait() error {
+	delay := l.delay(time.Now().UTC())
+	if delay == 0 {
+		return nil
+	}
+	if delay > MAX_RATE_LIMIT_WAIT {
+		return fmt.Errorf("strava rate limit reached, next window opens in %s", delay.Round(time.Second))
+	}
+	slog.Warn("Strava rate limit almost reached, delaying request", "delay", delay.Round(time.Second))
+	time.Sleep(delay)
+	return nil
+}
+
+func nearLimit(usage, limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	return float64(usage) >= float64(limit)*(1-RATE_LIMIT_HEADROOM)
+}
+
+func parseRateLimitHeader(value string) (int, int, bool) {
+	short, daily, found := strings.Cut(value, ",")
+	if !found {
+		return 0, 0, false
+	}
+	shortValue, err := strconv.Atoi(strings.TrimSpace(short))
+	if err != nil {
+		return 0, 0, false
+	}
+	dailyValue, err := strconv.Atoi(strings.TrimSpace(daily))
+	if err != nil {
+		return 0, 0, false
+	}
+	return shortValue, dailyValue, true
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// retryDelay is an exponential backoff with full jitter.
+func retryDelay(attempt int) time.Duration {
+	backoff := RETRY_BASE_DELAY << attempt
+	if backoff > RETRY_MAX_DELAY || backoff <= 0 {
+		backoff = RETRY_MAX_DELAY
+	}
+	return rand.N(backoff) + time.Millisecond
+}
+
+// isIdempotent tells whether the request can be sent again after a failure
+// that may have happened once the server acted on it. POST /oauth/token must
+// not be, an authorization code can only be exchanged once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	usage := strava.RateLimit()
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,107 @@
+package route
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"time"
+)
+
+// Track is a route to export with its name and start time. Summary
+// polylines are simplified and carry no timestamps, so only the track start
+// is known.
+type Track struct {
+	Name  string
+	Start time.Time
+	// Properties are copied as is into the GeoJSON feature.
+	Properties map[string]any
+	Points     []Point
+}
+
+const GPX_CREATOR = "strava2cal"
+
+type gpxDocument struct {
+	XMLName xml.Name   `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string          `xml:"name"`
+	Segment gpxTrackSegment `xml:"trkseg"`
+}
+
+type gpxTrackSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lng float64 `xml:"lon,attr"`
+	// Time is only set on the first point, the start of the track.
+	Time string `xml:"time,omitempty"`
+}
+
+// WriteGPX writes the tracks as a GPX 1.1 document.
+func WriteGPX(w io.Writer, tracks []Track) error {
+	doc := gpxDocument{Version: "1.1", Creator: GPX_CREATOR}
+	for _, track := range tracks {
+		trk := gpxTrack{Name: track.Name}
+		for _, point := range track.Points {
+			trk.Segment.Points = append(trk.Segment.Points, gpxPoint{Lat: point.Lat, Lng: point.Lng})
+		}
+		if len(trk.Segment.Points) > 0 && !track.Start.IsZero() {
+			trk.Segment.Points[0].Time = track.Start.UTC().Format(time.RFC3339)
+		}
+		doc.Tracks = append(doc.Tracks, trk)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type featureCollection struct {
+	Type     string    `json:"type"`
+	Features []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string         `json:"type"`
+	Geometry   lineString     `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+type lineString struct {
+	Type string `json:"type"`
+	// Coordinates are longitude, latitude pairs as RFC 7946 requires.
+	Coordinates [][2]float64 `json:"coordinates"`
+}
+
+// WriteGeoJSON writes the tracks as a GeoJSON FeatureCollection of
+// LineStrings.
+func WriteGeoJSON(w io.Writer, tracks []Track) error {
+	collection := featureCollection{Type: "FeatureCollection", Features: []feature{}}
+	for _, track := range tracks {
+		geometry := lineString{Type: "LineString", Coordinates: make([][2]float64, len(track.Points))}
+		for i, point := range track.Points {
+			geometry.Coordinates[i] = [2]float64{point.Lng, point.Lat}
+		}
+		properties := map[string]any{"name": track.Name}
+		if !track.Start.IsZero() {
+			properties["start_date"] = track.Start.UTC().Format(time.RFC3339)
+		}
+		for key, value := range track.Properties {
+			properties[key] = value
+		}
+		collection.Features = append(collection.Features, feature{Type: "Feature", Geometry: geometry, Properties: properties})
+	}
+	return json.NewEncoder(w).Encode(collection)
+}
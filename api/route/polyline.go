@@ -0,0 +1,59 @@
+// Package route decodes activity routes and draws them as small map sketches.
+package route
+
+import "fmt"
+
+// Point is a position in decimal degrees.
+type Point struct {
+	Lat, Lng float64
+}
+
+// POLYLINE_PRECISION is the number of decimals kept by the encoded polyline
+// algorithm, as used by Strava summary polylines.
+const POLYLINE_PRECISION = 1e5
+
+// DecodePolyline decodes a Google encoded polyline.
+func DecodePolyline(polyline string) ([]Point, error) {
+	var points []Point
+	var lat, lng int
+	for i := 0; i < len(polyline); {
+		dLat, next, err := decodeValue(polyline, i)
+		if err != nil {
+			return nil, err
+		}
+		dLng, next, err := decodeValue(polyline, next)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+		lat += dLat
+		lng += dLng
+		points = append(points, Point{Lat: float64(lat) / POLYLINE_PRECISION, Lng: float64(lng) / POLYLINE_PRECISION})
+	}
+	return points, nil
+}
+
+// decodeValue reads the variable length value starting at i, returning it
+// with the index following it.
+func decodeValue(polyline string, i int) (int, int, error) {
+	result, shift := 0, 0
+	for {
+		if i >= len(polyline) {
+			return 0, i, fmt.Errorf("truncated polyline")
+		}
+		b := int(polyline[i]) - 63
+		i++
+		if b < 0 || b > 0x3f+0x20 {
+			return 0, i, fmt.Errorf("invalid polyline character %q", polyline[i-1])
+		}
+		result |= (b & 0x1f) << shift
+		shift += 5
+		if b < 0x20 {
+			break
+		}
+	}
+	if result&1 != 0 {
+		return ^(result >> 1), i, nil
+	}
+	return result >> 1, i, nil
+}
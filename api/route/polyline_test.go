@@ -0,0 +1,48 @@
+package route
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodePolyline(t *testing.T) {
+	tests := []struct {
+		polyline string
+		want     []Point
+	}{
+		// The example of the encoded polyline algorithm documentation.
+		{"_p~iF~ps|U_ulLnnqC_mqNvxq`@", []Point{{38.5, -120.2}, {40.7, -120.95}, {43.252, -126.453}}},
+		{"", nil},
+		{"??", []Point{{0, 0}}},
+	}
+	for _, test := range tests {
+		got, err := DecodePolyline(test.polyline)
+		if err != nil {
+			t.Errorf("DecodePolyline(%q): %v", test.polyline, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("DecodePolyline(%q) = %v, want %v", test.polyline, got, test.want)
+			continue
+		}
+		for i := range got {
+			if math.Abs(got[i].Lat-test.want[i].Lat) > 1e-9 || math.Abs(got[i].Lng-test.want[i].Lng) > 1e-9 {
+				t.Errorf("DecodePolyline(%q)[%d] = %v, want %v", test.polyline, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestDecodePolylineErrors(t *testing.T) {
+	for _, polyline := range []string{
+		// Truncated in the middle of a value, then of a pair.
+		"_p~iF~ps|",
+		"_p~iF",
+		// Below '?', outside the alphabet.
+		"_p~iF ps|U",
+	} {
+		if _, err := DecodePolyline(polyline); err == nil {
+			t.Errorf("DecodePolyline(%q) succeeded, want an error", polyline)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package route
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+var (
+	BACKGROUND_COLOR = color.RGBA{0xf4, 0xf1, 0xec, 0xff}
+	ROUTE_COLOR      = color.RGBA{0xfc, 0x4c, 0x02, 0xff}
+	START_COLOR      = color.RGBA{0x2e, 0x9e, 0x44, 0xff}
+	END_COLOR        = color.RGBA{0xc6, 0x28, 0x28, 0xff}
+)
+
+const (
+	ROUTE_WIDTH = 3
+	MARKER_SIZE = 5
+)
+
+// Sketch draws the route on a plain background, without map tiles. The route
+// is projected equirectangularly around its center latitude, which is close
+// enough at the scale of an activity, and fitted in the image with padding.
+func Sketch(points []Point, width, height, padding int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, BACKGROUND_COLOR)
+		}
+	}
+	if len(points) == 0 {
+		return img
+	}
+
+	minLat, maxLat, minLng, maxLng := points[0].Lat, points[0].Lat, points[0].Lng, points[0].Lng
+	for _, p := range points[1:] {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLng, maxLng = math.Min(minLng, p.Lng), math.Max(maxLng, p.Lng)
+	}
+	lngScale := math.Cos((minLat + maxLat) / 2 * math.Pi / 180)
+	spanX := (maxLng - minLng) * lngScale
+	spanY := maxLat - minLat
+	scale := math.Min(
+		float64(width-2*padding)/math.Max(spanX, 1e-9),
+		float64(height-2*padding)/math.Max(spanY, 1e-9),
+	)
+	// Center the route on both axes.
+	offsetX := (float64(width) - spanX*scale) / 2
+	offsetY := (float64(height) - spanY*scale) / 2
+	project := func(p Point) (float64, float64) {
+		return offsetX + (p.Lng-minLng)*lngScale*scale, offsetY + (maxLat-p.Lat)*scale
+	}
+
+	x0, y0 := project(points[0])
+	for _, p := range points[1:] {
+		x1, y1 := project(p)
+		drawLine(img, x0, y0, x1, y1, ROUTE_WIDTH, ROUTE_COLOR)
+		x0, y0 = x1, y1
+	}
+	drawDisc(img, x0, y0, MARKER_SIZE, END_COLOR)
+	startX, startY := project(points[0])
+	drawDisc(img, startX, startY, MARKER_SIZE, START_COLOR)
+	return img
+}
+
+// EncodePNG draws the route sketch as a PNG.
+func EncodePNG(w io.Writer, points []Point, width, height, padding int) error {
+	return png.Encode(w, Sketch(points, width, height, padding))
+}
+
+// drawLine stamps discs along the segment, one per pixel of length.
+func drawLine(img *image.RGBA, x0, y0, x1, y1, width float64, c color.RGBA) {
+	steps := int(math.Max(math.Abs(x1-x0), math.Abs(y1-y0))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		drawDisc(img, x0+(x1-x0)*t, y0+(y1-y0)*t, width/2, c)
+	}
+}
+
+func drawDisc(img *image.RGBA, cx, cy, radius float64, c color.RGBA) {
+	bounds := img.Bounds()
+	for y := int(cy - radius); y <= int(cy+radius)+1; y++ {
+		for x := int(cx - radius); x <= int(cx+radius)+1; x++ {
+			dx, dy := float64(x)+0.5-cx, float64(y)+0.5-cy
+			if dx*dx+dy*dy <= radius*radius && image.Pt(x, y).In(bounds) {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
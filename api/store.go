@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Store persists the athletes' Strava tokens, their activities, the webhook
+// subscription, the saved feeds, the queue of webhook events and the audit
+// log. Lookups return a nil value and a nil error when
+// nothing matches.
+type Store interface {
+	GetToken(athleteId int) (*StravaToken, error)
+	GetTokenByFeed(feedToken string) (*StravaToken, error)
+	// GetTokenByManagement looks the token up by the hash of its management
+	// token.
+	GetTokenByManagement(managementToken string) (*StravaToken, error)
+	// SaveToken upserts the OAuth part of the token and leaves the feed token,
+	// management token, last fetch and settings untouched, use SetFeedToken,
+	// SetManagementToken, SetLastFetch and SetFeedSettings to change them.
+	SaveToken(token *StravaToken) error
+	// SetFeedToken replaces the athlete's feed token, an empty token revokes it.
+	SetFeedToken(athleteId int, feedToken string) error
+	// SetManagementToken replaces the hash of the athlete's management token.
+	SetManagementToken(athleteId int, managementToken string) error
+	SetFeedSettings(athleteId int, settings FeedSettings) error
+	SetLastFetch(athleteId int, fetchedAt time.Time) error
+	// DeleteAthlete removes the athlete's token, feed token, feeds and
+	// activities.
+	DeleteAthlete(athleteId int) error
+	// MigrateLegacyToken keys the token stored before tokens were keyed by
+	// athlete by the id athleteId resolves, and gives that id to the
+	// activities stored without one. It's a no-op when no such token is left
+	// and returns the number of activities migrated.
+	MigrateLegacyToken(athleteId func(token *StravaToken) (int, error)) (int, error)
+
+	GetActivity(athleteId, id int) (*Activity, error)
+	GetActivities(athleteId int, filter ActivityFilter) ([]Activity, error)
+	// EachActivity calls fn with each activity matching the filter, oldest
+	// first, without loading them all in memory. It stops at the first error
+	// of fn and returns it. fn must not use the store.
+	EachActivity(athleteId int, filter ActivityFilter, fn func(*Activity) error) error
+	// UpsertActivity stores the activity as fetched from FetchActivity,
+	// replacing the stored copy.
+	UpsertActivity(activity *Activity) error
+	// UpsertActivities stores activities of the activity list, keeping the
+	// detail-only fields of the stored copies, see Activity.keepDetails.
+	UpsertActivities(activities []Activity) error
+	RemoveActivity(athleteId, id int) error
+	// LatestActivityStart returns the start date of the athlete's most recent
+	// activity, or the zero time if none is stored.
+	LatestActivityStart(athleteId int) (time.Time, error)
+
+	// SaveFeed inserts or replaces a saved feed.
+	SaveFeed(feed *Feed) error
+	GetFeed(id string) (*Feed, error)
+	ListFeeds(athleteId int) ([]Feed, error)
+	// DeleteFeed removes the feed if it belongs to the athlete and reports
+	// whether it did.
+	DeleteFeed(athleteId int, id string) (bool, error)
+
+	// GetSubscription returns the id of the registered webhook subscription,
+	// or 0 if there is none.
+	GetSubscription() (int, error)
+	SaveSubscription(id int) error
+	RemoveSubscription() error
+
+	// SaveEvent inserts or replaces a webhook event.
+	SaveEvent(event *WebhookEvent) error
+	// ClaimEvent atomically picks the oldest live event due at now, counts the
+	// attempt and pushes its next run past the lease. Returns nil when the
+	// queue is empty.
+	ClaimEvent(now time.Time, lease time.Duration) (*WebhookEvent, error)
+	GetEvent(id string) (*WebhookEvent, error)
+	DeleteEvent(id string) error
+	ListDeadEvents() ([]WebhookEvent, error)
+
+	SaveAuditEntry(entry *AuditEntry) error
+
+	// MigrateActivityTypes converts the activities and feed filters stored
+	// with the English display names of the activity types to the Strava
+	// sport types. Only data from before the conversion matches so it's a
+	// no-op once done. Returns the number of activities converted.
+	MigrateActivityTypes() (int, error)
+
+	Close() error
+}
+
+var store Store
+
+func initStore() error {
+	var err error
+	switch STORE {
+	case "", "mongo":
+		store, err = newMongoStore(MONGO_URI, MONGO_DB)
+	case "sqlite":
+		path := SQLITE_PATH
+		if path == "" {
+			path = "strava2cal.db"
+		}
+		store, err = newSQLiteStore(path)
+	case "memory":
+		slog.Warn("Using the in-memory store, all data will be lost on restart")
+		store = newMemoryStore()
+	default:
+		err = fmt.Errorf("unknown store backend %q", STORE)
+	}
+	return err
+}
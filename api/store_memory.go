@@ -0,0 +1,375 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mu             sync.Mutex
+	tokens         map[int]StravaToken
+	activities     map[int]Activity
+	feeds          map[string]Feed
+	subscriptionId int
+	events         map[string]WebhookEvent
+	audit          []AuditEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tokens:     make(map[int]StravaToken),
+		activities: make(map[int]Activity),
+		feeds:      make(map[string]Feed),
+		events:     make(map[string]WebhookEvent),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) GetToken(athleteId int) (*StravaToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[athleteId]
+	if !ok {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+func (s *memoryStore) GetTokenByFeed(feedToken string) (*StravaToken, error) {
+	if feedToken == "" {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.FeedToken == feedToken {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) GetTokenByManagement(managementToken string) (*StravaToken, error) {
+	if managementToken == "" {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.ManagementToken == managementToken {
+			return &token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) SaveToken(token *StravaToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *token
+	saved.FeedToken = s.tokens[token.AthleteId].FeedToken
+	saved.ManagementToken = s.tokens[token.AthleteId].ManagementToken
+	saved.LastFetchAt = s.tokens[token.AthleteId].LastFetchAt
+	saved.FeedSettings = s.tokens[token.AthleteId].FeedSettings
+	s.tokens[token.AthleteId] = saved
+	return nil
+}
+
+func (s *memoryStore) SetFeedToken(athleteId int, feedToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[athleteId]
+	if !ok {
+		return nil
+	}
+	token.FeedToken = feedToken
+	s.tokens[athleteId] = token
+	return nil
+}
+
+func (s *memoryStore) SetManagementToken(athleteId int, managementToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[athleteId]
+	if !ok {
+		return nil
+	}
+	token.ManagementToken = managementToken
+	s.tokens[athleteId] = token
+	return nil
+}
+
+func (s *memoryStore) SetFeedSettings(athleteId int, settings FeedSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[athleteId]
+	if !ok {
+		return nil
+	}
+	token.FeedSettings = &settings
+	s.tokens[athleteId] = token
+	return nil
+}
+
+func (s *memoryStore) SetLastFetch(athleteId int, fetchedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[athleteId]
+	if !ok {
+		return nil
+	}
+	token.LastFetchAt = fetchedAt
+	s.tokens[athleteId] = token
+	return nil
+}
+
+func (s *memoryStore) DeleteAthlete(athleteId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, athleteId)
+	for id, activity := range s.activities {
+		if activity.AthleteId == athleteId {
+			delete(s.activities, id)
+		}
+	}
+	for id, feed := range s.feeds {
+		if feed.AthleteId == athleteId {
+			delete(s.feeds, id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) MigrateLegacyToken(athleteId func(token *StravaToken) (int, error)) (int, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) GetActivity(athleteId, id int) (*Activity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	activity, ok := s.activities[id]
+	if !ok || activity.AthleteId != athleteId {
+		return nil, nil
+	}
+	return &activity, nil
+}
+
+func (s *memoryStore) GetActivities(athleteId int, filter ActivityFilter) ([]Activity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Activity
+	for _, activity := range s.activities {
+		if activity.AthleteId == athleteId && filter.Matches(&activity) {
+			out = append(out, activity)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) EachActivity(athleteId int, filter ActivityFilter, fn func(*Activity) error) error {
+	activities, _ := s.GetActivities(athleteId, filter)
+	slices.SortFunc(activities, func(a, b Activity) int {
+		return strings.Compare(a.StartDate, b.StartDate)
+	})
+	for i := range activities {
+		if err := fn(&activities[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) UpsertActivity(activity *Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activities[activity.Id] = *activity
+	return nil
+}
+
+func (s *memoryStore) UpsertActivities(activities []Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, activity := range activities {
+		if stored, ok := s.activities[activity.Id]; ok {
+			activity.keepDetails(&stored)
+		}
+		s.activities[activity.Id] = activity
+	}
+	return nil
+}
+
+func (s *memoryStore) LatestActivityStart(athleteId int) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	latest := ""
+	for _, activity := range s.activities {
+		if activity.AthleteId == athleteId && activity.StartDate > latest {
+			latest = activity.StartDate
+		}
+	}
+	if latest == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(ACTIVITY_DATE_FORMAT, latest)
+}
+
+func (s *memoryStore) RemoveActivity(athleteId, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if activity, ok := s.activities[id]; ok && activity.AthleteId == athleteId {
+		delete(s.activities, id)
+	}
+	return nil
+}
+
+func (s *memoryStore) GetSubscription() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subscriptionId, nil
+}
+
+func (s *memoryStore) SaveSubscription(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptionId = id
+	return nil
+}
+
+func (s *memoryStore) RemoveSubscription() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptionId = 0
+	return nil
+}
+
+func (s *memoryStore) SaveFeed(feed *Feed) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feeds[feed.Id] = *feed
+	return nil
+}
+
+func (s *memoryStore) GetFeed(id string) (*Feed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feed, ok := s.feeds[id]
+	if !ok {
+		return nil, nil
+	}
+	return &feed, nil
+}
+
+func (s *memoryStore) ListFeeds(athleteId int) ([]Feed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []Feed
+	for _, feed := range s.feeds {
+		if feed.AthleteId == athleteId {
+			out = append(out, feed)
+		}
+	}
+	slices.SortFunc(out, func(a, b Feed) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out, nil
+}
+
+func (s *memoryStore) DeleteFeed(athleteId int, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if feed, ok := s.feeds[id]; ok && feed.AthleteId == athleteId {
+		delete(s.feeds, id)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (s *memoryStore) SaveEvent(event *WebhookEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[event.Id] = *event
+	return nil
+}
+
+func (s *memoryStore) ClaimEvent(now time.Time, lease time.Duration) (*WebhookEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *WebhookEvent
+	for _, event := range s.events {
+		if event.Dead || event.NextRunAt.After(now) {
+			continue
+		}
+		if next == nil || event.NextRunAt.Before(next.NextRunAt) {
+			next = &event
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Attempts++
+	next.NextRunAt = now.Add(lease)
+	s.events[next.Id] = *next
+	return next, nil
+}
+
+func (s *memoryStore) GetEvent(id string) (*WebhookEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event, ok := s.events[id]
+	if !ok {
+		return nil, nil
+	}
+	return &event, nil
+}
+
+func (s *memoryStore) DeleteEvent(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.events, id)
+	return nil
+}
+
+func (s *memoryStore) ListDeadEvents() ([]WebhookEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []WebhookEvent
+	for _, event := range s.events {
+		if event.Dead {
+			out = append(out, event)
+		}
+	}
+	slices.SortFunc(out, func(a, b WebhookEvent) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return out, nil
+}
+
+func (s *memoryStore) SaveAuditEntry(entry *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, *entry)
+	return nil
+}
+
+func (s *memoryStore) MigrateActivityTypes() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for id, activity := range s.activities {
+		if activity.migrateType() {
+			s.activities[id] = activity
+			count++
+		}
+	}
+	for id, feed := range s.feeds {
+		if feed.Filter.migrateTypes() {
+			s.feeds[id] = feed
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type mongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+func newMongoStore(uri, database string) (*mongoStore, error) {
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(ctx)
+		return nil, err
+	}
+
+	return &mongoStore{client: client, db: client.Database(database)}, nil
+}
+
+func (s *mongoStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
+
+func (s *mongoStore) findToken(filter bson.D) (*StravaToken, error) {
+	var token StravaToken
+	err := s.db.Collection("token").FindOne(context.Background(), filter).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *mongoStore) GetToken(athleteId int) (*StravaToken, error) {
+	return s.findToken(bson.D{{Key: "_id", Value: athleteId}})
+}
+
+func (s *mongoStore) GetTokenByFeed(feedToken string) (*StravaToken, error) {
+	if feedToken == "" {
+		return nil, nil
+	}
+	return s.findToken(bson.D{{Key: "feed_token", Value: feedToken}})
+}
+
+func (s *mongoStore) GetTokenByManagement(managementToken string) (*StravaToken, error) {
+	if managementToken == "" {
+		return nil, nil
+	}
+	return s.findToken(bson.D{{Key: "management_token", Value: managementToken}})
+}
+
+func (s *mongoStore) SaveToken(token *StravaToken) error {
+	_, err := s.db.Collection("token").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: token.AthleteId}},
+		bson.D{{Key: "$set", Value: token}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) SetFeedToken(athleteId int, feedToken string) error {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "feed_token", Value: feedToken}}}}
+	if feedToken == "" {
+		update = bson.D{{Key: "$unset", Value: bson.D{{Key: "feed_token", Value: ""}}}}
+	}
+	_, err := s.db.Collection("token").UpdateOne(context.Background(), bson.D{{Key: "_id", Value: athleteId}}, update)
+	return err
+}
+
+func (s *mongoStore) SetManagementToken(athleteId int, managementToken string) error {
+	_, err := s.db.Collection("token").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: athleteId}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "management_token", Value: managementToken}}}},
+	)
+	return err
+}
+
+func (s *mongoStore) SetFeedSettings(athleteId int, settings FeedSettings) error {
+	_, err := s.db.Collection("token").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: athleteId}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "feed_settings", Value: settings}}}},
+	)
+	return err
+}
+
+func (s *mongoStore) SetLastFetch(athleteId int, fetchedAt time.Time) error {
+	_, err := s.db.Collection("token").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: athleteId}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "last_fetch_at", Value: fetchedAt}}}},
+	)
+	return err
+}
+
+func (s *mongoStore) DeleteAthlete(athleteId int) error {
+	_, err := s.db.Collection("activities").DeleteMany(context.Background(), bson.D{{Key: "athlete_id", Value: athleteId}})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Collection("feeds").DeleteMany(context.Background(), bson.D{{Key: "athlete_id", Value: athleteId}})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Collection("token").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: athleteId}})
+	return err
+}
+
+// LEGACY_TOKEN_ID is the id of the token of single-athlete deployments.
+const LEGACY_TOKEN_ID = "token"
+
+func (s *mongoStore) MigrateLegacyToken(athleteId func(token *StravaToken) (int, error)) (int, error) {
+	var token StravaToken
+	err := s.db.Collection("token").FindOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: LEGACY_TOKEN_ID}},
+		options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 0}}),
+	).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	token.AthleteId, err = athleteId(&token)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve the athlete of the legacy token: %w", err)
+	}
+	if err := s.SaveToken(&token); err != nil {
+		return 0, err
+	}
+	result, err := s.db.Collection("activities").UpdateMany(
+		context.Background(),
+		bson.D{{Key: "athlete_id", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "athlete_id", Value: token.AthleteId}}}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.db.Collection("token").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: LEGACY_TOKEN_ID}})
+	return int(result.ModifiedCount), err
+}
+
+func (s *mongoStore) UpsertActivity(activity *Activity) error {
+	_, err := s.db.Collection("activities").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: activity.Id}},
+		bson.D{{Key: "$set", Value: activity}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) UpsertActivities(activities []Activity) error {
+	if len(activities) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(activities))
+	for i := range activities {
+		update, err := activitySummaryUpdate(&activities[i])
+		if err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: activities[i].Id}}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+	_, err := s.db.Collection("activities").BulkWrite(context.Background(), models)
+	return err
+}
+
+// activitySummaryUpdate sets the activity, except for the empty detail-only
+// fields which are only set when inserting, see Activity.keepDetails.
+func activitySummaryUpdate(activity *Activity) (bson.D, error) {
+	data, err := bson.Marshal(activity)
+	if err != nil {
+		return nil, err
+	}
+	var fields bson.M
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	onInsert := bson.M{}
+	for key, empty := range map[string]bool{
+		"description": activity.Description == "",
+		"calories":    activity.Calories == 0,
+		"devicename":  activity.DeviceName == "",
+	} {
+		if empty {
+			onInsert[key] = fields[key]
+			delete(fields, key)
+		}
+	}
+	update := bson.D{{Key: "$set", Value: fields}}
+	if len(onInsert) > 0 {
+		update = append(update, bson.E{Key: "$setOnInsert", Value: onInsert})
+	}
+	return update, nil
+}
+
+func (s *mongoStore) LatestActivityStart(athleteId int) (time.Time, error) {
+	var activity Activity
+	err := s.db.Collection("activities").FindOne(
+		context.Background(),
+		bson.D{{Key: "athlete_id", Value: athleteId}},
+		options.FindOne().SetSort(bson.D{{Key: "startdate", Value: -1}}),
+	).Decode(&activity)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(ACTIVITY_DATE_FORMAT, activity.StartDate)
+}
+
+func (s *mongoStore) GetActivity(athleteId, id int) (*Activity, error) {
+	var activity Activity
+	err := s.db.Collection("activities").FindOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "athlete_id", Value: athleteId},
+	}).Decode(&activity)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &activity, nil
+}
+
+// activitiesQuery translates the filter, field names are the Activity ones
+// lowercased by the bson encoder.
+func activitiesQuery(athleteId int, filter ActivityFilter) bson.D {
+	query := bson.D{{Key: "athlete_id", Value: athleteId}}
+
+	typeCondition := bson.D{}
+	if len(filter.Types) > 0 {
+		typeCondition = append(typeCondition, bson.E{Key: "$in", Value: filter.Types})
+	}
+	if len(filter.ExcludeTypes) > 0 {
+		typeCondition = append(typeCondition, bson.E{Key: "$nin", Value: filter.ExcludeTypes})
+	}
+	if len(typeCondition) > 0 {
+		query = append(query, bson.E{Key: "sport_type", Value: typeCondition})
+	}
+
+	startCondition := bson.D{}
+	if !filter.Since.IsZero() {
+		startCondition = append(startCondition, bson.E{Key: "$gte", Value: filter.Since.UTC().Format(ACTIVITY_DATE_FORMAT)})
+	}
+	if !filter.Until.IsZero() {
+		startCondition = append(startCondition, bson.E{Key: "$lt", Value: filter.Until.UTC().Format(ACTIVITY_DATE_FORMAT)})
+	}
+	if len(startCondition) > 0 {
+		query = append(query, bson.E{Key: "startdate", Value: startCondition})
+	}
+
+	if filter.MinDistance > 0 {
+		query = append(query, bson.E{Key: "distance", Value: bson.D{{Key: "$gte", Value: filter.MinDistance}}})
+	}
+	// Activities stored before the flags were only match false.
+	if filter.Commute != nil {
+		query = append(query, bson.E{Key: "commute", Value: flagCondition(*filter.Commute)})
+	}
+	if filter.Trainer != nil {
+		query = append(query, bson.E{Key: "trainer", Value: flagCondition(*filter.Trainer)})
+	}
+	if len(filter.Gear) > 0 {
+		query = append(query, bson.E{Key: "gearid", Value: bson.D{{Key: "$in", Value: filter.Gear}}})
+	}
+	return query
+}
+
+func flagCondition(flag bool) any {
+	if flag {
+		return true
+	}
+	return bson.D{{Key: "$ne", Value: true}}
+}
+
+func (s *mongoStore) GetActivities(athleteId int, filter ActivityFilter) ([]Activity, error) {
+	var out []Activity
+	err := s.EachActivity(athleteId, filter, func(a *Activity) error {
+		out = append(out, *a)
+		return nil
+	})
+	return out, err
+}
+
+func (s *mongoStore) EachActivity(athleteId int, filter ActivityFilter, fn func(*Activity) error) error {
+	cur, err := s.db.Collection("activities").Find(
+		context.Background(),
+		activitiesQuery(athleteId, filter),
+		options.Find().SetSort(bson.D{{Key: "startdate", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+	for cur.Next(context.Background()) {
+		var a Activity
+		if err := cur.Decode(&a); err != nil {
+			return err
+		}
+		if err := fn(&a); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func (s *mongoStore) RemoveActivity(athleteId, id int) error {
+	_, err := s.db.Collection("activities").DeleteOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "athlete_id", Value: athleteId},
+	})
+	return err
+}
+
+func (s *mongoStore) GetSubscription() (int, error) {
+	var content struct {
+		SubscriptionId int `bson:"subscription_id"`
+	}
+	err := s.db.Collection("subscription").FindOne(context.Background(), bson.D{{Key: "_id", Value: "subscription"}}).Decode(&content)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return content.SubscriptionId, nil
+}
+
+func (s *mongoStore) SaveSubscription(id int) error {
+	_, err := s.db.Collection("subscription").UpdateOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: "subscription"}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "subscription_id", Value: id}}}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) RemoveSubscription() error {
+	_, err := s.db.Collection("subscription").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: "subscription"}})
+	return err
+}
+
+func (s *mongoStore) SaveFeed(feed *Feed) error {
+	_, err := s.db.Collection("feeds").ReplaceOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: feed.Id}},
+		feed,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) GetFeed(id string) (*Feed, error) {
+	var feed Feed
+	err := s.db.Collection("feeds").FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&feed)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (s *mongoStore) ListFeeds(athleteId int) ([]Feed, error) {
+	cur, err := s.db.Collection("feeds").Find(
+		context.Background(),
+		bson.D{{Key: "athlete_id", Value: athleteId}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var out []Feed
+	if err := cur.All(context.Background(), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *mongoStore) DeleteFeed(athleteId int, id string) (bool, error) {
+	res, err := s.db.Collection("feeds").DeleteOne(context.Background(), bson.D{
+		{Key: "_id", Value: id},
+		{Key: "athlete_id", Value: athleteId},
+	})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (s *mongoStore) SaveEvent(event *WebhookEvent) error {
+	_, err := s.db.Collection("events").ReplaceOne(
+		context.Background(),
+		bson.D{{Key: "_id", Value: event.Id}},
+		event,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) ClaimEvent(now time.Time, lease time.Duration) (*WebhookEvent, error) {
+	var event WebhookEvent
+	err := s.db.Collection("events").FindOneAndUpdate(
+		context.Background(),
+		bson.D{
+			{Key: "dead", Value: false},
+			{Key: "next_run_at", Value: bson.D{{Key: "$lte", Value: now}}},
+		},
+		bson.D{
+			{Key: "$set", Value: bson.D{{Key: "next_run_at", Value: now.Add(lease)}}},
+			{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_run_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&event)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (s *mongoStore) GetEvent(id string) (*WebhookEvent, error) {
+	var event WebhookEvent
+	err := s.db.Collection("events").FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&event)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (s *mongoStore) DeleteEvent(id string) error {
+	_, err := s.db.Collection("events").DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
+	return err
+}
+
+func (s *mongoStore) ListDeadEvents() ([]WebhookEvent, error) {
+	cur, err := s.db.Collection("events").Find(
+		context.Background(),
+		bson.D{{Key: "dead", Value: true}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var out []WebhookEvent
+	if err := cur.All(context.Background(), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *mongoStore) SaveAuditEntry(entry *AuditEntry) error {
+	_, err := s.db.Collection("audit").InsertOne(context.Background(), entry)
+	return err
+}
+
+func (s *mongoStore) MigrateActivityTypes() (int, error) {
+	cur, err := s.db.Collection("activities").Find(context.Background(), bson.D{{Key: "sport_type", Value: bson.D{{Key: "$exists", Value: false}}}})
+	if err != nil {
+		return 0, err
+	}
+	var activities []Activity
+	if err := cur.All(context.Background(), &activities); err != nil {
+		return 0, err
+	}
+	models := make([]mongo.WriteModel, 0, len(activities))
+	for i := range activities {
+		activities[i].migrateType()
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: activities[i].Id}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{
+				{Key: "sport_type", Value: activities[i].SportType},
+				{Key: "type", Value: activities[i].Type},
+			}}}))
+	}
+	if len(models) > 0 {
+		if _, err := s.db.Collection("activities").BulkWrite(context.Background(), models); err != nil {
+			return 0, err
+		}
+	}
+
+	cur, err = s.db.Collection("feeds").Find(context.Background(), bson.D{})
+	if err != nil {
+		return 0, err
+	}
+	var feeds []Feed
+	if err := cur.All(context.Background(), &feeds); err != nil {
+		return 0, err
+	}
+	for i := range feeds {
+		if feeds[i].Filter.migrateTypes() {
+			if err := s.SaveFeed(&feeds[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(activities), nil
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order, PRAGMA user_version records how many
+// of them already ran on the database file.
+var sqliteMigrations = []string{
+	`CREATE TABLE tokens (
+		athlete_id       INTEGER PRIMARY KEY,
+		access_token     TEXT NOT NULL,
+		refresh_token    TEXT NOT NULL,
+		expires_at       INTEGER NOT NULL,
+		feed_token       TEXT UNIQUE,
+		management_token TEXT UNIQUE
+	);
+	CREATE TABLE activities (
+		id         INTEGER PRIMARY KEY,
+		athlete_id INTEGER NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX activities_athlete_id ON activities (athlete_id);
+	CREATE TABLE subscription (
+		id              INTEGER PRIMARY KEY CHECK (id = 1),
+		subscription_id INTEGER NOT NULL
+	);`,
+	`ALTER TABLE tokens ADD COLUMN last_fetch_at INTEGER;`,
+	`CREATE TABLE events (
+		id          TEXT PRIMARY KEY,
+		next_run_at INTEGER NOT NULL,
+		dead        INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL,
+		data        TEXT NOT NULL
+	);
+	CREATE INDEX events_next_run_at ON events (dead, next_run_at);`,
+	`CREATE TABLE audit (
+		time       INTEGER NOT NULL,
+		athlete_id INTEGER NOT NULL,
+		action     TEXT NOT NULL,
+		details    TEXT NOT NULL
+	);`,
+	`ALTER TABLE tokens ADD COLUMN feed_settings TEXT;`,
+	`CREATE TABLE feeds (
+		id         TEXT PRIMARY KEY,
+		athlete_id INTEGER NOT NULL,
+		data       TEXT NOT NULL
+	);
+	CREATE INDEX feeds_athlete_id ON feeds (athlete_id);`,
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only supports a single writer, serializing everything through one
+	// connection avoids SQLITE_BUSY errors.
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlite migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) findToken(where string, arg any) (*StravaToken, error) {
+	var token StravaToken
+	var feedToken, managementToken, feedSettings sql.NullString
+	var lastFetchAt sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT athlete_id, access_token, refresh_token, expires_at, feed_token, management_token, last_fetch_at, feed_settings FROM tokens WHERE "+where,
+		arg,
+	).Scan(&token.AthleteId, &token.AccessToken, &token.RefreshToken, &token.ExpiresAt, &feedToken, &managementToken, &lastFetchAt, &feedSettings)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	token.FeedToken = feedToken.String
+	token.ManagementToken = managementToken.String
+	if lastFetchAt.Valid {
+		token.LastFetchAt = time.UnixMilli(lastFetchAt.Int64).UTC()
+	}
+	if feedSettings.Valid {
+		token.FeedSettings = &FeedSettings{}
+		if err := json.Unmarshal([]byte(feedSettings.String), token.FeedSettings); err != nil {
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+func (s *sqliteStore) GetToken(athleteId int) (*StravaToken, error) {
+	return s.findToken("athlete_id = ?", athleteId)
+}
+
+func (s *sqliteStore) GetTokenByFeed(feedToken string) (*StravaToken, error) {
+	if feedToken == "" {
+		return nil, nil
+	}
+	return s.findToken("feed_token = ?", feedToken)
+}
+
+func (s *sqliteStore) GetTokenByManagement(managementToken string) (*StravaToken, error) {
+	if managementToken == "" {
+		return nil, nil
+	}
+	return s.findToken("management_token = ?", managementToken)
+}
+
+func (s *sqliteStore) SaveToken(token *StravaToken) error {
+	_, err := s.db.Exec(
+		`INSERT INTO tokens (athlete_id, access_token, refresh_token, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (athlete_id) DO UPDATE SET
+			access_token = excluded.access_token,
+			refresh_token = excluded.refresh_token,
+			expires_at = excluded.expires_at`,
+		token.AthleteId, token.AccessToken, token.RefreshToken, token.ExpiresAt,
+	)
+	return err
+}
+
+func (s *sqliteStore) SetFeedToken(athleteId int, feedToken string) error {
+	_, err := s.db.Exec(
+		"UPDATE tokens SET feed_token = ? WHERE athlete_id = ?",
+		sql.NullString{String: feedToken, Valid: feedToken != ""}, athleteId,
+	)
+	return err
+}
+
+func (s *sqliteStore) SetManagementToken(athleteId int, managementToken string) error {
+	_, err := s.db.Exec(
+		"UPDATE tokens SET management_token = ? WHERE athlete_id = ?",
+		sql.NullString{String: managementToken, Valid: managementToken != ""}, athleteId,
+	)
+	return err
+}
+
+func (s *sqliteStore) SetFeedSettings(athleteId int, settings FeedSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE tokens SET feed_settings = ? WHERE athlete_id = ?", string(data), athleteId)
+	return err
+}
+
+func (s *sqliteStore) SetLastFetch(athleteId int, fetchedAt time.Time) error {
+	_, err := s.db.Exec("UPDATE tokens SET last_fetch_at = ? WHERE athlete_id = ?", fetchedAt.UnixMilli(), athleteId)
+	return err
+}
+
+func (s *sqliteStore) DeleteAthlete(athleteId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM activities WHERE athlete_id = ?", athleteId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM feeds WHERE athlete_id = ?", athleteId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tokens WHERE athlete_id = ?", athleteId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateLegacyToken has nothing to do, the SQLite store came after tokens
+// were keyed by athlete.
+func (s *sqliteStore) MigrateLegacyToken(athleteId func(token *StravaToken) (int, error)) (int, error) {
+	return 0, nil
+}
+
+func (s *sqliteStore) GetActivity(athleteId, id int) (*Activity, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM activities WHERE id = ? AND athlete_id = ?", id, athleteId).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var activity Activity
+	if err := json.Unmarshal(data, &activity); err != nil {
+		return nil, err
+	}
+	return &activity, nil
+}
+
+// sqliteActivitiesQuery translates the filter into a WHERE clause over the JSON
+// encoded activities.
+func sqliteActivitiesQuery(athleteId int, filter ActivityFilter) (string, []any) {
+	where := []string{"athlete_id = ?"}
+	args := []any{athleteId}
+
+	if len(filter.Types) > 0 {
+		where = append(where, "json_extract(data, '$.sport_type') IN ("+sqlPlaceholders(len(filter.Types))+")")
+		for _, t := range filter.Types {
+			args = append(args, t)
+		}
+	}
+	if len(filter.ExcludeTypes) > 0 {
+		where = append(where, "json_extract(data, '$.sport_type') NOT IN ("+sqlPlaceholders(len(filter.ExcludeTypes))+")")
+		for _, t := range filter.ExcludeTypes {
+			args = append(args, t)
+		}
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "json_extract(data, '$.start_date') >= ?")
+		args = append(args, filter.Since.UTC().Format(ACTIVITY_DATE_FORMAT))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "json_extract(data, '$.start_date') < ?")
+		args = append(args, filter.Until.UTC().Format(ACTIVITY_DATE_FORMAT))
+	}
+	if filter.MinDistance > 0 {
+		where = append(where, "json_extract(data, '$.distance') >= ?")
+		args = append(args, filter.MinDistance)
+	}
+	// Activities stored before the flags have them NULL, counted as false.
+	if filter.Commute != nil {
+		where = append(where, "coalesce(json_extract(data, '$.commute'), 0) = ?")
+		args = append(args, *filter.Commute)
+	}
+	if filter.Trainer != nil {
+		where = append(where, "coalesce(json_extract(data, '$.trainer'), 0) = ?")
+		args = append(args, *filter.Trainer)
+	}
+	if len(filter.Gear) > 0 {
+		where = append(where, "json_extract(data, '$.gear_id') IN ("+sqlPlaceholders(len(filter.Gear))+")")
+		for _, gear := range filter.Gear {
+			args = append(args, gear)
+		}
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func sqlPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", count), ", ")
+}
+
+func (s *sqliteStore) GetActivities(athleteId int, filter ActivityFilter) ([]Activity, error) {
+	var out []Activity
+	err := s.EachActivity(athleteId, filter, func(a *Activity) error {
+		out = append(out, *a)
+		return nil
+	})
+	return out, err
+}
+
+// SQLITE_ACTIVITY_BATCH is how many activities EachActivity reads at once.
+// The single connection is only held while reading a batch, not while fn
+// runs, so that a slow download doesn't block the rest of the application.
+const SQLITE_ACTIVITY_BATCH = 500
+
+func (s *sqliteStore) EachActivity(athleteId int, filter ActivityFilter, fn func(*Activity) error) error {
+	where, args := sqliteActivitiesQuery(athleteId, filter)
+	lastStart, lastId := "", 0
+	for first := true; ; first = false {
+		query, queryArgs := where, args
+		if !first {
+			// Resume after the last activity of the previous batch.
+			query += " AND (coalesce(json_extract(data, '$.start_date'), '') > ? OR (coalesce(json_extract(data, '$.start_date'), '') = ? AND id > ?))"
+			queryArgs = append(slices.Clip(args), lastStart, lastStart, lastId)
+		}
+		batch, err := s.activityBatch(query, queryArgs)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			if err := fn(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < SQLITE_ACTIVITY_BATCH {
+			return nil
+		}
+		lastStart, lastId = batch[len(batch)-1].StartDate, batch[len(batch)-1].Id
+	}
+}
+
+func (s *sqliteStore) activityBatch(where string, args []any) ([]Activity, error) {
+	rows, err := s.db.Query(
+		"SELECT data FROM activities WHERE "+where+" ORDER BY coalesce(json_extract(data, '$.start_date'), ''), id LIMIT ?",
+		append(slices.Clip(args), SQLITE_ACTIVITY_BATCH)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	batch := make([]Activity, 0, SQLITE_ACTIVITY_BATCH)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var a Activity
+		if err := json.Unmarshal(data, &a); err != nil {
+			return nil, err
+		}
+		batch = append(batch, a)
+	}
+	return batch, rows.Err()
+}
+
+func upsertSQLiteActivity(exec func(string, ...any) (sql.Result, error), activity *Activity) error {
+	data, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	_, err = exec(
+		`INSERT INTO activities (id, athlete_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET athlete_id = excluded.athlete_id, data = excluded.data`,
+		activity.Id, activity.AthleteId, string(data),
+	)
+	return err
+}
+
+func (s *sqliteStore) UpsertActivity(activity *Activity) error {
+	return upsertSQLiteActivity(s.db.Exec, activity)
+}
+
+func (s *sqliteStore) UpsertActivities(activities []Activity) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := range activities {
+		activity := activities[i]
+		var data []byte
+		err := tx.QueryRow("SELECT data FROM activities WHERE id = ?", activity.Id).Scan(&data)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if err == nil {
+			var stored Activity
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			activity.keepDetails(&stored)
+		}
+		if err := upsertSQLiteActivity(tx.Exec, &activity); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) LatestActivityStart(athleteId int) (time.Time, error) {
+	var latest sql.NullString
+	err := s.db.QueryRow(
+		"SELECT MAX(json_extract(data, '$.start_date')) FROM activities WHERE athlete_id = ?",
+		athleteId,
+	).Scan(&latest)
+	if err != nil || !latest.Valid {
+		return time.Time{}, err
+	}
+	return time.Parse(ACTIVITY_DATE_FORMAT, latest.String)
+}
+
+func (s *sqliteStore) RemoveActivity(athleteId, id int) error {
+	_, err := s.db.Exec("DELETE FROM activities WHERE id = ? AND athlete_id = ?", id, athleteId)
+	return err
+}
+
+func (s *sqliteStore) GetSubscription() (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT subscription_id FROM subscription WHERE id = 1").Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (s *sqliteStore) SaveSubscription(id int) error {
+	_, err := s.db.Exec(
+		`INSERT INTO subscription (id, subscription_id) VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET subscription_id = excluded.subscription_id`,
+		id,
+	)
+	return err
+}
+
+func (s *sqliteStore) RemoveSubscription() error {
+	_, err := s.db.Exec("DELETE FROM subscription")
+	return err
+}
+
+func (s *sqliteStore) SaveFeed(feed *Feed) error {
+	data, err := json.Marshal(feed)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO feeds (id, athlete_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET athlete_id = excluded.athlete_id, data = excluded.data`,
+		feed.Id, feed.AthleteId, string(data),
+	)
+	return err
+}
+
+func scanSQLiteFeed(row interface{ Scan(...any) error }) (*Feed, error) {
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var feed Feed
+	if err := json.Unmarshal(data, &feed); err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (s *sqliteStore) GetFeed(id string) (*Feed, error) {
+	return scanSQLiteFeed(s.db.QueryRow("SELECT data FROM feeds WHERE id = ?", id))
+}
+
+func (s *sqliteStore) ListFeeds(athleteId int) ([]Feed, error) {
+	rows, err := s.db.Query(
+		"SELECT data FROM feeds WHERE athlete_id = ? ORDER BY json_extract(data, '$.created_at')",
+		athleteId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Feed
+	for rows.Next() {
+		feed, err := scanSQLiteFeed(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *feed)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) DeleteFeed(athleteId int, id string) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM feeds WHERE id = ? AND athlete_id = ?", id, athleteId)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func saveSQLiteEvent(exec func(string, ...any) (sql.Result, error), event *WebhookEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = exec(
+		`INSERT INTO events (id, next_run_at, dead, created_at, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			next_run_at = excluded.next_run_at,
+			dead = excluded.dead,
+			data = excluded.data`,
+		event.Id, event.NextRunAt.UnixMilli(), event.Dead, event.CreatedAt.UnixMilli(), string(data),
+	)
+	return err
+}
+
+func scanSQLiteEvent(row interface{ Scan(...any) error }) (*WebhookEvent, error) {
+	var data []byte
+	if err := row.Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (s *sqliteStore) SaveEvent(event *WebhookEvent) error {
+	return saveSQLiteEvent(s.db.Exec, event)
+}
+
+func (s *sqliteStore) ClaimEvent(now time.Time, lease time.Duration) (*WebhookEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	event, err := scanSQLiteEvent(tx.QueryRow(
+		"SELECT data FROM events WHERE dead = 0 AND next_run_at <= ? ORDER BY next_run_at LIMIT 1",
+		now.UnixMilli(),
+	))
+	if err != nil || event == nil {
+		return nil, err
+	}
+	event.Attempts++
+	event.NextRunAt = now.Add(lease)
+	if err := saveSQLiteEvent(tx.Exec, event); err != nil {
+		return nil, err
+	}
+	return event, tx.Commit()
+}
+
+func (s *sqliteStore) GetEvent(id string) (*WebhookEvent, error) {
+	return scanSQLiteEvent(s.db.QueryRow("SELECT data FROM events WHERE id = ?", id))
+}
+
+func (s *sqliteStore) DeleteEvent(id string) error {
+	_, err := s.db.Exec("DELETE FROM events WHERE id = ?", id)
+	return err
+}
+
+func (s *sqliteStore) ListDeadEvents() ([]WebhookEvent, error) {
+	rows, err := s.db.Query("SELECT data FROM events WHERE dead = 1 ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []WebhookEvent
+	for rows.Next() {
+		event, err := scanSQLiteEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *event)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) SaveAuditEntry(entry *AuditEntry) error {
+	_, err := s.db.Exec(
+		"INSERT INTO audit (time, athlete_id, action, details) VALUES (?, ?, ?, ?)",
+		entry.Time.UnixMilli(), entry.AthleteId, entry.Action, entry.Details,
+	)
+	return err
+}
+
+func (s *sqliteStore) MigrateActivityTypes() (int, error) {
+	rows, err := s.db.Query("SELECT data FROM activities WHERE json_extract(data, '$.sport_type') IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	var activities []Activity
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var a Activity
+		if err := json.Unmarshal(data, &a); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		a.migrateType()
+		activities = append(activities, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := s.UpsertActivities(activities); err != nil {
+		return 0, err
+	}
+
+	rows, err = s.db.Query("SELECT data FROM feeds")
+	if err != nil {
+		return 0, err
+	}
+	var feeds []Feed
+	for rows.Next() {
+		feed, err := scanSQLiteFeed(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if feed.Filter.migrateTypes() {
+			feeds = append(feeds, *feed)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for i := range feeds {
+		if err := s.SaveFeed(&feeds[i]); err != nil {
+			return 0, err
+		}
+	}
+	return len(activities), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_STRAVA_BASE_URL = "https://www.strava.com"
+	STRAVA_REQUEST_TIMEOUT  = 30 * time.Second
+)
+
+// StravaClient talks to the Strava API. BaseURL and HTTPClient can be swapped
+// to target a fake Strava server or to go through an egress proxy.
+type StravaClient struct {
+	BaseURL      string
+	HTTPClient   *http.Client
+	ClientId     string
+	ClientSecret string
+	UserAgent    string
+
+	limiter *rateLimiter
+}
+
+var strava *StravaClient
+
+func NewStravaClient(clientId, clientSecret string) *StravaClient {
+	return &StravaClient{
+		BaseURL: DEFAULT_STRAVA_BASE_URL,
+		HTTPClient: &http.Client{
+			Timeout: STRAVA_REQUEST_TIMEOUT,
+		},
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		UserAgent:    "strava2cal",
+		limiter:      &rateLimiter{},
+	}
+}
+
+// RateLimit returns the API quota usage as last reported by Strava.
+func (c *StravaClient) RateLimit() RateLimitUsage {
+	return c.limiter.current(time.Now().UTC())
+}
+
+// initStravaClient builds the client from the environment: STRAVA_BASE_URL
+// overrides the API host and STRAVA_PROXY routes every call through a proxy
+// (the standard HTTPS_PROXY variables are honoured otherwise).
+func initStravaClient() error {
+	strava = NewStravaClient(CLIENT_ID, CLIENT_SECRET)
+	if STRAVA_BASE_URL != "" {
+		strava.BaseURL = strings.TrimSuffix(STRAVA_BASE_URL, "/")
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if STRAVA_PROXY != "" {
+		proxyURL, err := url.Parse(STRAVA_PROXY)
+		if err != nil {
+			return err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	strava.HTTPClient.Transport = transport
+	return nil
+}
+
+// AuthorizeURL is the Strava page the athlete is sent to in order to grant
+// access to the application.
+func (c *StravaClient) AuthorizeURL(redirectURI string) string {
+	q := url.Values{}
+	q.Set("client_id", c.ClientId)
+	q.Set("response_type", "code")
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", "activity:read_all")
+	return c.BaseURL + "/oauth/authorize?" + q.Encode()
+}
+
+// newRequest builds a request against the Strava API, path is relative to
+// the base URL.
+func (c *StravaClient) newRequest(method, path string, query url.Values) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+	}
+	return req, nil
+}
+
+// clientQuery returns query parameters carrying the application credentials.
+func (c *StravaClient) clientQuery() url.Values {
+	q := url.Values{}
+	q.Set("client_id", c.ClientId)
+	q.Set("client_secret", c.ClientSecret)
+	return q
+}
+
+// do sends the request once the rate limit allows it. 429 responses, which
+// Strava rejects before acting on them, are sent again once the window
+// resets. 5xx responses and transport errors are only retried for idempotent
+// requests, with a jittered exponential backoff. Requests must not have a body
+// so they can be sent again.
+func (c *StravaClient) do(req *http.Request) (*http.Response, error) {
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.HTTPClient.Do(req)
+		lastAttempt := attempt+1 >= MAX_REQUEST_ATTEMPTS
+		if err != nil {
+			if lastAttempt || !isIdempotent(req) {
+				return nil, err
+			}
+			delay := retryDelay(attempt)
+			slog.Warn("Strava request failed, retrying", "error", err, "path", req.URL.Path, "attempt", attempt+1, "delay", delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		c.limiter.update(resp.Header)
+		switch {
+		case lastAttempt:
+			return resp, nil
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// The next attempt waits in limiter.wait for the window to reset.
+			c.limiter.throttle(time.Now().UTC())
+			slog.Warn("Strava rate limit exceeded, retrying in the next window", "path", req.URL.Path, "attempt", attempt+1)
+			resp.Body.Close()
+		case resp.StatusCode >= http.StatusInternalServerError && isIdempotent(req):
+			delay := retryDelay(attempt)
+			slog.Warn("Strava request failed, retrying", "status_code", resp.StatusCode, "path", req.URL.Path, "attempt", attempt+1, "delay", delay)
+			resp.Body.Close()
+			time.Sleep(delay)
+		default:
+			return resp, nil
+		}
+	}
+}
@@ -3,27 +3,23 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 )
 
-func registerWebhook(callbackUrl, verifyToken string) error {
-	webhookUrl := "https://www.strava.com/api/v3/push_subscriptions"
+func (c *StravaClient) RegisterWebhook(callbackUrl, verifyToken string) (int, error) {
+	q := c.clientQuery()
+	q.Add("callback_url", callbackUrl)
+	q.Add("verify_token", verifyToken)
 
-	req, err := http.NewRequest("POST", webhookUrl, nil)
+	req, err := c.newRequest("POST", "/api/v3/push_subscriptions", q)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	q := req.URL.Query()
-	q.Add("client_id", CLIENT_ID)
-	q.Add("client_secret", CLIENT_SECRET)
-	q.Add("callback_url", callbackUrl)
-	q.Add("verify_token", verifyToken)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
@@ -33,29 +29,24 @@ func registerWebhook(callbackUrl, verifyToken string) error {
 
 	err = json.NewDecoder(resp.Body).Decode(&content)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to register webhook, status code: %d", resp.StatusCode)
+		return 0, fmt.Errorf("failed to register webhook, status code: %d", resp.StatusCode)
 	}
-	return nil
+	return content.Id, nil
 }
 
-func getWebhook() (int, error) {
-	webhookUrl := "https://www.strava.com/api/v3/push_subscriptions"
+func (c *StravaClient) GetWebhook() (int, error) {
+	q := c.clientQuery()
 
-	req, err := http.NewRequest("GET", webhookUrl, nil)
+	req, err := c.newRequest("GET", "/api/v3/push_subscriptions", q)
 	if err != nil {
 		return 0, err
 	}
 
-	q := req.URL.Query()
-	q.Add("client_id", CLIENT_ID)
-	q.Add("client_secret", CLIENT_SECRET)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -79,20 +70,15 @@ func getWebhook() (int, error) {
 	return content[0].Id, nil
 }
 
-func unregisterWebhook(subscriptionId int) error {
-	webhookUrl := fmt.Sprintf("https://www.strava.com/api/v3/push_subscriptions/%d", subscriptionId)
+func (c *StravaClient) UnregisterWebhook(subscriptionId int) error {
+	q := c.clientQuery()
 
-	req, err := http.NewRequest("DELETE", webhookUrl, nil)
+	req, err := c.newRequest("DELETE", fmt.Sprintf("/api/v3/push_subscriptions/%d", subscriptionId), q)
 	if err != nil {
 		return err
 	}
 
-	q := req.URL.Query()
-	q.Add("client_id", CLIENT_ID)
-	q.Add("client_secret", CLIENT_SECRET)
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
@@ -103,3 +89,18 @@ func unregisterWebhook(subscriptionId int) error {
 	}
 	return nil
 }
+
+// syncSubscription stores the id of a subscription registered before it was
+// kept in the store, /hook rejects the events of any other subscription.
+func syncSubscription() error {
+	subscriptionId, err := store.GetSubscription()
+	if err != nil || subscriptionId != 0 {
+		return err
+	}
+	subscriptionId, err = strava.GetWebhook()
+	if err != nil || subscriptionId == 0 {
+		return err
+	}
+	slog.Info("Webhook subscription found", "subscription_id", subscriptionId)
+	return store.SaveSubscription(subscriptionId)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+)
+
+// The templates execute with the *Activity as data, e.g. {{.Name}} or
+// {{distance .Distance}}, and can use the templateFuncs.
+const DEFAULT_TITLE_TEMPLATE = "{{sport .SportType}} | {{.Name}}"
+
+// The templates are run for every activity of every calendar fetch, so their
+// cost is bounded: they have no loops, see checkTemplateNode, their length is
+// capped and their output is cut at the maximum length of the event field.
+const (
+	MAX_TEMPLATE_LENGTH    = 2000
+	MAX_TITLE_LENGTH       = 256
+	MAX_DESCRIPTION_LENGTH = 4096
+	MAX_NUMBER_DECIMALS    = 6
+)
+
+var errTemplateOutputTooLong = errors.New("template output too long")
+
+// limitedBuilder keeps the first limit bytes written and fails the write
+// past that, which stops the template execution.
+type limitedBuilder struct {
+	strings.Builder
+	limit int
+}
+
+func (b *limitedBuilder) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.Builder.Write(p[:room])
+		return room, errTemplateOutputTooLong
+	}
+	return b.Builder.Write(p)
+}
+
+// String returns the output, without a rune cut by the limit.
+func (b *limitedBuilder) String() string {
+	out := b.Builder.String()
+	for !utf8.ValidString(out) {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// printfVerbPattern matches the verbs of a printf format, flags, width and
+// precision included.
+var (
+	printfVerbPattern  = regexp.MustCompile(`%[-+# 0-9.*\[\]]*`)
+	largeNumberPattern = regexp.MustCompile(`[0-9]{3,}`)
+)
+
+// templatePrintf replaces the printf builtin, refusing the widths and
+// precisions that would make it build huge strings, e.g. %0999999d.
+func templatePrintf(format string, args ...any) (string, error) {
+	for _, verb := range printfVerbPattern.FindAllString(format, -1) {
+		if strings.ContainsAny(verb, "*[") || largeNumberPattern.MatchString(verb) {
+			return "", fmt.Errorf("printf verb %q is not allowed", verb)
+		}
+	}
+	return fmt.Sprintf(format, args...), nil
+}
+
+// checkTemplateNode rejects the actions whose cost doesn't depend on the
+// template length: range, which also loops over integers, and template, which
+// may recurse.
+func checkTemplateNode(node parse.Node) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			if err := checkTemplateNode(child); err != nil {
+				return err
+			}
+		}
+	case *parse.IfNode:
+		return checkBranchNode(&node.BranchNode)
+	case *parse.WithNode:
+		return checkBranchNode(&node.BranchNode)
+	case *parse.RangeNode:
+		return errors.New("range is not allowed")
+	case *parse.TemplateNode:
+		return errors.New("template is not allowed")
+	}
+	return nil
+}
+
+func checkBranchNode(node *parse.BranchNode) error {
+	if err := checkTemplateNode(node.List); err != nil {
+		return err
+	}
+	return checkTemplateNode(node.ElseList)
+}
+
+// templateFuncs returns the template helpers, printing in the formatter unit
+// system and language.
+func templateFuncs(f formatter) template.FuncMap {
+	return template.FuncMap{
+		// t translates a message of the catalog, e.g. {{t "Duration"}}.
+		"t": f.locale.text,
+		// sport is the localized name of an activity type.
+		"sport": f.locale.typeName,
+		"number": func(value float32, decimals int) string {
+			return f.locale.number(float64(value), min(max(decimals, 0), MAX_NUMBER_DECIMALS))
+		},
+		"date": f.date,
+		// duration formats seconds, e.g. 1h2m3s.
+		"duration": func(seconds int) string {
+			return (time.Duration(seconds) * time.Second).String()
+		},
+		// pace formats the time to cover the distance in meters at the speed
+		// in m/s as m:ss, e.g. {{pace .AvgSpeed 1000}} for min/km.
+		"pace":       formatPace,
+		"distance":   f.distance,
+		"elevation":  f.elevation,
+		"speed":      f.speed,
+		"speedLabel": f.speedLabel,
+		"km": func(meters float32) float64 {
+			return float64(meters) / 1000
+		},
+		"mi": func(meters float32) float64 {
+			return float64(meters) / 1609.344
+		},
+		"feet": func(meters float32) float64 {
+			return float64(meters) / 0.3048
+		},
+		"kmh": func(speed float32) float64 {
+			return float64(speed) * 3.6
+		},
+		"mph": func(speed float32) float64 {
+			return float64(speed) * 3600 / 1609.344
+		},
+		"stravaUrl": func(id int) string {
+			return fmt.Sprintf("strava.com/activities/%d", id)
+		},
+		"printf": templatePrintf,
+	}
+}
+
+func formatPace(speed float32, meters float64) string {
+	if speed <= 0 {
+		return ""
+	}
+	seconds := int(meters/float64(speed) + 0.5)
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// sampleActivity is rendered to validate the templates before saving them,
+// and by the preview endpoint.
+var sampleActivity = Activity{
+	BaseActivity: BaseActivity{
+		Id:          123456789,
+		Name:        "Morning Ride",
+		Distance:    42195,
+		Elevation:   512,
+		Timezone:    "(GMT+01:00) Europe/Paris",
+		AvgSpeed:    7.5,
+		AvgWatts:    210,
+		AvgCadence:  88,
+		ElapsedTime: 5625,
+		Visibility:  "everyone",
+
+		MovingTime:   5410,
+		AvgHeartrate: 142,
+		MaxHeartrate: 176,
+		MaxSpeed:     15.2,
+		Kilojoules:   1136,
+		Calories:     1267,
+		SufferScore:  87,
+		GearId:       "b1234567",
+		DeviceName:   "Garmin Edge 540",
+		Commute:      false,
+		Trainer:      false,
+		Description:  "Easy spin along the river",
+		StartLatlng:  []float64{48.8566, 2.3522},
+		EndLatlng:    []float64{48.8606, 2.3376},
+		Map:          ActivityMap{SummaryPolyline: "_p~iF~ps|U_ulLnnqC_mqNvxq`@"},
+	},
+	AthleteId: 1,
+	SportType: "Ride",
+	Type:      "Ride",
+	StartDate: "20250601T070000Z",
+}
+
+type eventTemplates struct {
+	titleTemplate       *template.Template
+	descriptionTemplate *template.Template
+	locale              *locale
+}
+
+// eventTemplates parses the feed templates and renders the sample activity
+// with them, so that errors only showing at execution, such as an unknown
+// field, are caught too.
+func (s FeedSettings) eventTemplates(mapUrl func(*Activity) string) (*eventTemplates, error) {
+	formatter := s.formatter()
+	funcs := templateFuncs(formatter)
+	// mapUrl is the signed URL of the route sketch in the feed, empty without
+	// a map.
+	funcs["mapUrl"] = mapUrl
+	title, err := parseEventTemplate("title", s.TitleTemplate, DEFAULT_TITLE_TEMPLATE, MAX_TITLE_LENGTH, funcs)
+	if err != nil {
+		return nil, err
+	}
+	description, err := parseEventTemplate("description", s.DescriptionTemplate, DEFAULT_DESCRIPTION_TEMPLATE, MAX_DESCRIPTION_LENGTH, funcs)
+	if err != nil {
+		return nil, err
+	}
+	return &eventTemplates{titleTemplate: title, descriptionTemplate: description, locale: formatter.locale}, nil
+}
+
+func parseEventTemplate(name, text, defaultText string, maxLength int, funcs template.FuncMap) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	if len(text) > MAX_TEMPLATE_LENGTH {
+		return nil, fmt.Errorf("invalid %s template: longer than %d bytes", name, MAX_TEMPLATE_LENGTH)
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	if err := checkTemplateNode(tmpl.Tree.Root); err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	if _, err := executeEventTemplate(tmpl, &sampleActivity, maxLength); err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", name, err)
+	}
+	return tmpl, nil
+}
+
+// title falls back to the default title when the template fails on this
+// activity, so that one odd activity doesn't break the whole feed.
+func (t *eventTemplates) title(activity *Activity) string {
+	title, err := executeEventTemplate(t.titleTemplate, activity, MAX_TITLE_LENGTH)
+	if err != nil {
+		slog.Debug("Failed to render event title", "error", err, "activity_id", activity.Id)
+		return fmt.Sprintf("%s | %s", t.locale.typeName(activity.SportType), activity.Name)
+	}
+	return title
+}
+
+func (t *eventTemplates) description(activity *Activity) string {
+	description, err := executeEventTemplate(t.descriptionTemplate, activity, MAX_DESCRIPTION_LENGTH)
+	if err != nil {
+		slog.Debug("Failed to render event description", "error", err, "activity_id", activity.Id)
+		return fmt.Sprintf("strava.com/activities/%d", activity.Id)
+	}
+	return description
+}
+
+// executeEventTemplate renders the activity, cutting the output at maxLength
+// bytes.
+func executeEventTemplate(tmpl *template.Template, activity *Activity, maxLength int) (string, error) {
+	out := &limitedBuilder{limit: maxLength}
+	if err := tmpl.Execute(out, activity); err != nil && !errors.Is(err, errTemplateOutputTooLong) {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// handlePreviewTemplates renders the sample activity with the title and
+// description templates of the body, replying 400 with the error when they
+// are invalid. Like saving them, it needs the management token.
+func handlePreviewTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if _, ok := authenticateAthlete(w, r); !ok {
+		return
+	}
+
+	var settings FeedSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Failed to parse templates", http.StatusBadRequest)
+		return
+	}
+	if err := settings.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	templates, err := settings.eventTemplates((&Feed{Settings: settings}).mapUrl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"activity":    sampleActivity,
+		"title":       templates.title(&sampleActivity),
+		"description": templates.description(&sampleActivity),
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"time"
+	// The Docker image doesn't ship the tz database.
+	_ "time/tzdata"
+)
+
+// activityLocation resolves the Strava timezone, formatted like
+// "(GMT+01:00) Europe/Paris", to a location. It returns nil when the zone is
+// missing or unknown to the tz database.
+func activityLocation(timezone string) *time.Location {
+	name := timezone
+	if _, after, found := strings.Cut(timezone, ") "); found {
+		name = after
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || name == "UTC" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
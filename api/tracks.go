@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"strava2cal/route"
+)
+
+// activityTrack returns the route of the activity for the exports, or nil
+// when it has none or the privacy policies hide it, see
+// FeedSettings.feedActivity.
+func (s FeedSettings) activityTrack(original *Activity) (*route.Track, error) {
+	activity := s.feedActivity(original)
+	if activity == nil || activity.Map.SummaryPolyline == "" {
+		return nil, nil
+	}
+	points, err := route.DecodePolyline(activity.Map.SummaryPolyline)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := time.Parse(ACTIVITY_DATE_FORMAT, activity.StartDate)
+	return &route.Track{
+		Name:  activity.Name,
+		Start: start,
+		Properties: map[string]any{
+			"id":           activity.Id,
+			"sport_type":   activity.SportType,
+			"distance":     activity.Distance,
+			"elapsed_time": activity.ElapsedTime,
+			"commute":      activity.Commute,
+			"url":          fmt.Sprintf("https://www.strava.com/activities/%d", activity.Id),
+		},
+		Points: points,
+	}, nil
+}
+
+// handleActivityGPX exports the route of an activity, e.g.
+// /activities/123456789.gpx, authenticated by the management token.
+func handleActivityGPX(w http.ResponseWriter, r *http.Request) {
+	id, ok := strings.CutSuffix(r.PathValue("file"), ".gpx")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	activityId, err := strconv.Atoi(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+
+	activity, err := store.GetActivity(token.AthleteId, activityId)
+	if err != nil {
+		http.Error(w, "Failed to load activity", http.StatusInternalServerError)
+		return
+	}
+	if activity == nil {
+		http.NotFound(w, r)
+		return
+	}
+	track, err := token.feedSettings().activityTrack(activity)
+	if err != nil {
+		slog.Error("Failed to decode activity polyline", "error", err, "activity_id", activityId)
+		http.Error(w, "Failed to decode route", http.StatusInternalServerError)
+		return
+	}
+	if track == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.gpx"`, activityId))
+	if err := route.WriteGPX(w, []route.Track{*track}); err != nil {
+		slog.Error("Failed to write GPX", "error", err, "activity_id", activityId)
+	}
+}
+
+// handleActivitiesGeoJSON exports the routes of the activities matching the
+// calendar filters, e.g. /activities.geojson?type=Ride&commute=true&since=2025-06-01,
+// authenticated by the management token. Activities without a route are left
+// out.
+func handleActivitiesGeoJSON(w http.ResponseWriter, r *http.Request) {
+	token, ok := authenticateAthlete(w, r)
+	if !ok {
+		return
+	}
+	filter, err := parseActivityFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	activities, err := store.GetActivities(token.AthleteId, filter)
+	if err != nil {
+		http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+		return
+	}
+	settings := token.feedSettings()
+	var tracks []route.Track
+	for _, activity := range activities {
+		track, err := settings.activityTrack(&activity)
+		if err != nil {
+			slog.Warn("Skipping activity with an invalid polyline", "error", err, "activity_id", activity.Id)
+			continue
+		}
+		if track != nil {
+			tracks = append(tracks, *track)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	if err := route.WriteGeoJSON(w, tracks); err != nil {
+		slog.Error("Failed to write GeoJSON", "error", err, "athlete_id", token.AthleteId)
+	}
+}